@@ -9,13 +9,19 @@ import (
 	"go-jwks-server/internal/httpsrv"
 	"go-jwks-server/internal/keyfiles"
 	"go-jwks-server/internal/keyloader"
+	"go-jwks-server/internal/keysource"
 	"go-jwks-server/internal/logger"
+	"go-jwks-server/internal/webhook"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/rs/zerolog"
 	"golang.org/x/sync/errgroup"
+
+	// the database drivers of the sql key source
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
 )
 
 var log zerolog.Logger
@@ -42,22 +48,44 @@ func main() {
 
 	keyfiles.SetLogger(log)
 	keyloader.SetLogger(log)
+	keysource.SetLogger(log)
 	httphandler.SetLogger(log)
+	webhook.SetLogger(log)
 
 	ctx, cancel := shutdownContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	kl, err := keyloader.NewKeyloader(config.Keyloader)
+	// registered before the first load, a SIGHUP received while starting would terminate the process otherwise,
+	// it is handled once the keys are loaded
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	kl, err := keyloader.NewKeyloader(config.Keyloader, nil)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to create keyloader")
 		return
 	}
 
-	if !config.Keyloader.WatchOn() {
-		if err := kl.LoadKeys(); err != nil {
-			log.Fatal().Err(err).Msg("failed to load keys")
+	var notifier *webhook.Notifier
+	var keysDiffs <-chan keyloader.KeysDiff
+
+	if config.Webhook.Enabled() {
+		notifier, err = webhook.New(config.Webhook)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create webhook notifier")
 			return
 		}
+
+		// subscribe before the first load, so the initial keys are notified too
+		var unsubscribe func()
+		keysDiffs, unsubscribe = kl.Subscribe()
+		defer unsubscribe()
+	}
+
+	if err := kl.LoadKeys(); err != nil {
+		log.Fatal().Err(err).Msg("failed to load keys")
+		return
 	}
 
 	eg, ctx := errgroup.WithContext(ctx)
@@ -112,16 +140,33 @@ func main() {
 		})
 	}
 
-	if config.Keyloader.WatchOn() {
+	// the sources that can not be watched, or have watching disabled, just wait for the context
+	eg.Go(func() error {
+		if err := kl.LoadKeysWatch(ctx); err != nil {
+			return fmt.Errorf("keyloader: %w", err)
+		}
+
+		return nil
+	})
+
+	if config.Webhook.Enabled() {
 		eg.Go(func() error {
-			if err := kl.LoadKeysWatch(ctx); err != nil {
-				return fmt.Errorf("keyloader: %w", err)
+			if err := notifier.Run(ctx, keysDiffs); err != nil {
+				return fmt.Errorf("webhook: %w", err)
 			}
 
 			return nil
 		})
 	}
 
+	eg.Go(func() error {
+		if err := reloadOnSignal(ctx, kl, reload); err != nil {
+			return fmt.Errorf("reload on signal: %w", err)
+		}
+
+		return nil
+	})
+
 	if err := eg.Wait(); err != nil {
 		log.Error().Err(err).Msg("service terminated with error")
 		return
@@ -147,3 +192,20 @@ func shutdownContext(ctx context.Context, signals ...os.Signal) (context.Context
 	}
 	return ctx, cancel
 }
+
+// reloadOnSignal reloads the keys every time a signal is received on ch, until the context is done
+func reloadOnSignal(ctx context.Context, kl *keyloader.Keyloader, ch <-chan os.Signal) error {
+	for {
+		select {
+		case sig := <-ch:
+			log.Info().Str("signal", sig.String()).Msg("received signal, reloading keys")
+
+			if err := kl.LoadKeys(); err != nil {
+				return err
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
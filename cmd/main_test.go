@@ -0,0 +1,91 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"go-jwks-server/internal/keyloader"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func writeTestKey(t *testing.T, path string) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("failed to generate key:", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal("failed to marshal key:", err)
+	}
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal("failed to write key:", err)
+	}
+}
+
+func TestReloadOnSignal(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKey(t, filepath.Join(dir, "key1.pub"))
+
+	config := keyloader.NewConfig()
+	config.Dirs = []string{dir}
+
+	kl, err := keyloader.NewKeyloader(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// registered like in main, so the signal sent below does not terminate the test
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	if err := kl.LoadKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- reloadOnSignal(ctx, kl, reload)
+	}()
+
+	writeTestKey(t, filepath.Join(dir, "key2.pub"))
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		if _, ok := kl.GetKeyInfo("key2"); ok {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatal("the keys were not reloaded on SIGHUP")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Errorf("reloadOnSignal() = %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// stringsFlag is a flag that can be provided multiple times, every occurrence adds to the list
+// a value can be a comma separated list, which is the way to provide multiple values in an environment variable
+// the first occurrence replaces the default values
+type stringsFlag struct {
+	values *[]string
+	set    bool
+}
+
+func newStringsFlag(values *[]string) *stringsFlag {
+	return &stringsFlag{values: values}
+}
+
+func (f *stringsFlag) String() string {
+	if f == nil || f.values == nil {
+		return ""
+	}
+
+	return strings.Join(*f.values, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	if !f.set {
+		*f.values = nil
+		f.set = true
+	}
+
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*f.values = append(*f.values, v)
+		}
+	}
+
+	return nil
+}
+
+// intsFlag is the integer version of stringsFlag
+type intsFlag struct {
+	values *[]int
+	set    bool
+}
+
+func newIntsFlag(values *[]int) *intsFlag {
+	return &intsFlag{values: values}
+}
+
+func (f *intsFlag) String() string {
+	if f == nil || f.values == nil {
+		return ""
+	}
+
+	s := make([]string, len(*f.values))
+	for i, v := range *f.values {
+		s[i] = strconv.Itoa(v)
+	}
+
+	return strings.Join(s, ",")
+}
+
+func (f *intsFlag) Set(value string) error {
+	if !f.set {
+		*f.values = nil
+		f.set = true
+	}
+
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+
+		*f.values = append(*f.values, i)
+	}
+
+	return nil
+}
+
+// keyValueFlag is a repeatable flag with key=value values, the values are not split on commas
+type keyValueFlag struct {
+	values *map[string]string
+}
+
+func newKeyValueFlag(values *map[string]string) *keyValueFlag {
+	return &keyValueFlag{values: values}
+}
+
+func (f *keyValueFlag) String() string {
+	if f == nil || f.values == nil {
+		return ""
+	}
+
+	keys := make([]string, 0, len(*f.values))
+	for k := range *f.values {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	// the values can be secret or long, show only the keys
+	return strings.Join(keys, ",")
+}
+
+func (f *keyValueFlag) Set(value string) error {
+	k, v, ok := strings.Cut(value, "=")
+	if !ok || k == "" {
+		return errors.New("the value must be in the key=value format")
+	}
+
+	if *f.values == nil {
+		*f.values = map[string]string{}
+	}
+
+	if _, exists := (*f.values)[k]; exists {
+		return fmt.Errorf("%s is provided more than once", k)
+	}
+
+	(*f.values)[k] = v
+
+	return nil
+}
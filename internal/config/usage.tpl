@@ -6,5 +6,58 @@ NOTE: It is not allowed to provide a flag both in the command line and in the en
 
 The -key-dir directory must contain the public keys, one key in a file. The file name is the key ID, files my have an optional .pub extension.  Files that have .ignore extension are ignored.
 
+The headers of a PEM block are used as metadata of its key, whatever the source: Kid sets the key ID, Alg and Use set the alg and use, Nbf and Exp (RFC 3339 or unix seconds) make the validity window of the key. The header names are case insensitive, the other headers are reported in the load logs. The PEM blocks that are not public keys, like certificates or private keys, and the text after the last block are skipped and reported in the load logs. The alg and use given by a source (like -key-manifest or -sql-dsn) take precedence, the key is published only inside both its validity windows. Example:
+
+    -----BEGIN PUBLIC KEY-----
+    Kid: signer-2024
+    Alg: PS256
+    Exp: 2025-01-01T00:00:00Z
+
+    MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA...
+    -----END PUBLIC KEY-----
+
+Several key directories can be provided, each is loaded and watched independently and the keys of all of them are served together. If the same key ID is found in more than one directory, the key from the directory listed first is served. A directory that fails to load does not prevent the keys of the others from being served.
+
+With -key-dir-recursive the keys are loaded from the subdirectories too, the key ID is the path relative to the key directory without the .pub extension, with the path elements joined by -key-id-path-separator (example: team-a/key1.pub becomes team-a/key1). Hidden subdirectories (like the ..data directories of kubernetes volumes) are skipped.
+
+More files can be skipped with the -key-include and -key-exclude glob patterns and with the patterns in the -key-ignore-file (gitignore style, read from the key directory). A pattern without a slash matches the file name at any depth, otherwise it matches the path relative to the key directory, ** matches any number of directories.
+
+Keys can also be loaded from single files with -key-file (the key ID is the file name without extension, a file with several PEM blocks gets the IDs name-1, name-2 and so on) and inline with -inline-key kid=material or with environment variables like {{.envVarPrefix}}KEY_SIGNER_ONE (the key ID is signer-one). On key ID conflicts the key directories take precedence over the key files and the key files over the inline keys. The default key directory is not used when only key files or inline keys are configured.
+
+With -key-archive the keys are loaded from the files of a tar, tar.gz or zip archive, one key in a file, with the key IDs and the skip rules of the key directories (-key-dir-recursive, -key-include, -key-exclude, -key-ignore-file at the root of the archive, -key-max-file-size). The archive is read whole and a load fails on any error, so a replaced archive is published as one update and a truncated one keeps the previous keys, replace the archive with a rename. On key ID conflicts the key archives come after the key files and before the inline keys.
+
+With -key-manifest the keys are listed in a YAML or JSON file, every entry has a kid, which a key ID in the material (a JWK kid or a Kid PEM header) must match, the key material in a file (relative to the manifest) or inline in pem, and the optional alg, use, nbf, exp (RFC 3339 or unix seconds) and labels. The aliases of an entry are other key IDs the same key is published under, for example the old key IDs after a change of the naming scheme, each alias can have its own exp. The whole manifest is validated and any error keeps the previous keys. The manifest and the key files it references are watched with -dir-watch-interval. On key ID conflicts the manifest comes after the key archives and before the inline keys. Example:
+
+    keys:
+      - kid: signer-2024
+        file: keys/signer-2024.pub
+        alg: PS256
+        exp: 2025-01-01T00:00:00Z
+        labels:
+          team: payments
+        aliases:
+          - kid: payments-signer-1
+            exp: 2024-07-01T00:00:00Z
+
+With -max-keys at most that many keys are published, the other keys are excluded, for example to clean up after the rotations that never remove the old key files. With -max-keys-group-by the cap applies to every group of keys: by source, by dir (the directory of the key file, useful with -key-dir-recursive and one directory per team) or by label:<name> (the labels of -key-manifest). The keys are kept in the order of -max-keys-order-by: mtime keeps the most recently modified keys, nbf the keys with the latest validity start and priority the keys with the highest priority label, the keys without a value come last and the ties go to the newest key. The aliases of a key follow it and do not count. The excluded key IDs are logged with the published keys and sent in the webhook payloads.
+
+With -remote-jwks-url the keys of upstream JWKS URLs (partners, legacy issuers) are merged into the served keys, after the local keys. An upstream is fetched again when its Cache-Control max-age expires (bounded by -remote-jwks-min-refresh-interval and -remote-jwks-max-refresh-interval), conditional requests are made with its ETag. While an upstream is down its last good response is served for up to -remote-jwks-max-stale.
+
+With -oidc-issuer the jwks_uri is taken from the /.well-known/openid-configuration document of the issuer, the issuer in the document must match the configured one. The document is resolved again every -oidc-discovery-interval, independently of the refresh of the keys, and a new jwks_uri is fetched right away. The keys are fetched like the ones of -remote-jwks-url. With alias=url the key IDs of the issuer are prefixed with the alias and -oidc-kid-separator (example: partner=https://login.partner.com makes key1 partner:key1).
+
+With -s3-bucket the keys are loaded from the objects of an S3 compatible bucket (AWS S3, MinIO), one key in an object, under -s3-prefix. The key ID is the object key relative to the prefix, like in recursive mode. The bucket is listed every -s3-poll-interval and only the objects with a changed ETag are downloaded again.
+
+With -git-repo the keys are loaded from the files under -git-path of a git repository at -git-ref (a branch, a tag or a commit), one key in a file. The key ID is the file path relative to -git-path, like in recursive mode. A local repository is read in place, a remote one is cloned into -git-cache-dir and fetched every -git-poll-interval, the keys are loaded again when the ref moves to another commit. The commit is logged with the published keys and sent in the webhook payloads. The git binary must be in the PATH, the server does not start without it; the docker image has git and openssh-client installed.
+
+With -k8s-label-selector the keys are loaded through the Kubernetes API from the Secrets and ConfigMaps matching the selector in the -k8s-namespace namespaces, every data entry is a key and its key ID is made by -k8s-kid-template. The objects are watched, so a new Secret is loaded without a restart. The service account needs the list and watch permissions on the resources. Without -k8s-api-server the in cluster address, token and CA of the service account are used.
+
+With -etcd-endpoint the keys are loaded from the values under -etcd-prefix through the etcd v3 JSON gateway, one key in a value. The key ID is the etcd key relative to the prefix, like in recursive mode. The prefix is watched from the revision of the last load, so the changes are published immediately and none is missed when the watch reconnects, a compacted revision loads the keys again.
+
+With -vault-transit-key the public keys of Vault transit keys are published, every available version of a key with the key ID <name>-v<version>. The keys are read again every -vault-poll-interval and the token is renewed before it expires, except the token of a -vault-token-file that is left to the Vault agent writing it.
+
+With -kms-key-id and -kms-alias-prefix the public keys of AWS KMS asymmetric signing keys are published, the private keys never leave KMS. The key ID is the KMS key id and the alg is the first of -kms-algorithms the key supports, the disabled keys and the keys pending deletion are skipped. The keys are read again every -kms-poll-interval. With -kms-endpoint a KMS compatible emulator can be used.
+
+With -sql-dsn the keys are loaded from a database (postgres or sqlite) with -sql-query, one row per key. The optional alg and use columns replace the ones of the key, the rows with an invalid alg or use are skipped and reported in the load logs, a key with nbf or exp columns is published only inside its validity window. The database is checked for changes with -sql-watermark-query every -sql-poll-interval. The server does not start if the database can not be reached.
+
 Supported flags:
 {{/* keep this line last */}}
\ No newline at end of file
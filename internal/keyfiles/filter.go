@@ -0,0 +1,262 @@
+package keyfiles
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// filter applies the configurable skip rules to the slash separated paths relative to the key directory
+type filter struct {
+	include    []string
+	exclude    []string
+	ignoreFile string
+	ignore     []ignoreRule
+}
+
+// ignoreRule is a single line of the ignore file
+type ignoreRule struct {
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+// newFilter creates the filter from the options, reading the ignore file from dir if present
+func newFilter(dir string, opts Options) (*filter, error) {
+	var data []byte
+
+	if opts.IgnoreFile != "" {
+		var err error
+
+		data, err = os.ReadFile(filepath.Join(dir, opts.IgnoreFile))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("read ignore file: %w", err)
+		}
+	}
+
+	return newFilterData(opts, data)
+}
+
+// newFilterData creates the filter from the options and the content of the ignore file, nil if there is none
+func newFilterData(opts Options, ignoreFile []byte) (*filter, error) {
+	f := &filter{
+		include:    opts.Include,
+		exclude:    opts.Exclude,
+		ignoreFile: opts.IgnoreFile,
+	}
+
+	for _, p := range append(append([]string{}, opts.Include...), opts.Exclude...) {
+		if err := validatePattern(p); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.IgnoreFile == "" || ignoreFile == nil {
+		return f, nil
+	}
+
+	var err error
+
+	f.ignore, err = parseIgnoreFile(ignoreFile)
+	if err != nil {
+		return nil, fmt.Errorf("parse ignore file %s: %w", opts.IgnoreFile, err)
+	}
+
+	return f, nil
+}
+
+// skip returns true and the reason if the file or directory must be skipped
+// the include patterns apply only to files
+func (f *filter) skip(name string, isDir bool) (bool, string) {
+	for _, p := range f.exclude {
+		if matchPattern(p, name) {
+			return true, fmt.Sprintf("excluded by pattern '%s'", p)
+		}
+	}
+
+	if ignored, pattern := f.ignored(name, isDir); ignored {
+		return true, fmt.Sprintf("ignored by %s pattern '%s'", f.ignoreFile, pattern)
+	}
+
+	if isDir || len(f.include) == 0 {
+		return false, ""
+	}
+
+	for _, p := range f.include {
+		if matchPattern(p, name) {
+			return false, ""
+		}
+	}
+
+	return true, "not matched by include patterns"
+}
+
+// ignored applies the rules of the ignore file, the last matching rule wins
+func (f *filter) ignored(name string, isDir bool) (bool, string) {
+	ignored := false
+	pattern := ""
+
+	for _, r := range f.ignore {
+		if r.dirOnly && !isDir {
+			continue
+		}
+
+		if matchPattern(r.pattern, name) {
+			ignored = !r.negate
+			pattern = r.pattern
+		}
+	}
+
+	return ignored, pattern
+}
+
+// parseIgnoreFile parses a gitignore style file
+// blank lines and lines starting with # are skipped, ! negates the pattern, a trailing / matches only directories
+func parseIgnoreFile(data []byte) ([]ignoreRule, error) {
+	var rules []ignoreRule
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		r := ignoreRule{}
+
+		if strings.HasPrefix(text, "!") {
+			r.negate = true
+			text = text[1:]
+		}
+
+		if strings.HasSuffix(text, "/") {
+			r.dirOnly = true
+			text = strings.TrimRight(text, "/")
+		}
+
+		if text == "" {
+			return nil, fmt.Errorf("line %d: empty pattern", line)
+		}
+
+		if err := validatePattern(text); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		r.pattern = text
+		rules = append(rules, r)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func validatePattern(pattern string) error {
+	for _, segment := range strings.Split(strings.TrimPrefix(pattern, "/"), "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("bad pattern '%s': %w", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// matchPattern matches a slash separated path against a gitignore style glob pattern
+// a pattern without a slash matches the base name at any depth, otherwise it matches
+// the whole path from the root, ** matches any number of directories
+func matchPattern(pattern, name string) bool {
+	if !strings.Contains(strings.TrimSuffix(pattern, "/"), "/") {
+		return matchSegments([]string{pattern}, []string{path.Base(name)})
+	}
+
+	return matchSegments(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// EntryFilter applies the rules of GetFileMetadata to files that are not read from a directory,
+// like the entries of an archive, the names are slash separated paths relative to the root
+type EntryFilter struct {
+	opts   Options
+	filter *filter
+}
+
+// NewEntryFilter creates the filter, ignoreFile is the content of Options.IgnoreFile at the root, nil if there is none
+func NewEntryFilter(opts Options, ignoreFile []byte) (*EntryFilter, error) {
+	f, err := newFilterData(opts, ignoreFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EntryFilter{opts: opts, filter: f}, nil
+}
+
+// Skip returns the path that is skipped and the reason, empty if the file is loaded
+// the path is the first directory of name that is skipped, like GetFileMetadata does not descend into it, or name itself
+// the symlink rules do not apply, the entries are not resolved on a file system
+func (f *EntryFilter) Skip(name string, info fs.FileInfo) (string, string) {
+	elements := strings.Split(name, "/")
+
+	for depth := 1; depth < len(elements); depth++ {
+		dir := strings.Join(elements[:depth], "/")
+
+		if !f.opts.Recursive {
+			return dir, "directory"
+		}
+
+		if skip, reason := skipDirName(elements[depth-1], depth, f.opts); skip {
+			return dir, reason
+		}
+
+		if skip, reason := f.filter.skip(dir, true); skip {
+			return dir, reason
+		}
+	}
+
+	if skip, reason := skipFileName(elements[len(elements)-1]); skip {
+		return name, reason
+	}
+
+	if skip, reason := f.filter.skip(name, false); skip {
+		return name, reason
+	}
+
+	if skip, reason := checkFile(info, f.opts); skip {
+		return name, reason
+	}
+
+	return "", ""
+}
@@ -0,0 +1,87 @@
+package keyfiles
+
+import (
+	"archive/tar"
+	"strings"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.pub", "key1.pub", true},
+		{"*.pub", "team-a/key1.pub", true},
+		{"*.pub", "key1", false},
+		{"team-a/*", "team-a/key1", true},
+		{"team-a/*", "team-a/deep/key1", false},
+		{"/team-a/*", "team-a/key1", true},
+		{"team-a/**", "team-a/deep/key1", true},
+		{"**/key1", "key1", true},
+		{"**/key1", "team-a/deep/key1", true},
+		{"team-a/**/key1", "team-a/key1", true},
+		{"team-a/**/key1", "team-b/key1", false},
+		{"key[0-9]", "key7", true},
+		{"key?", "key10", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEntryFilter(t *testing.T) {
+	opts := Options{
+		Recursive:   true,
+		MaxDepth:    2,
+		Exclude:     []string{"*.bak"},
+		IgnoreFile:  ".keyignore",
+		MaxFileSize: 50,
+	}
+
+	f, err := NewEntryFilter(opts, []byte("revoked/\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		size     int64
+		wantPath string
+		want     string
+	}{
+		{"key1.pub", 10, "", ""},
+		{"team-a/key2.pub", 10, "", ""},
+		{".keyignore", 10, ".keyignore", "hidden file"},
+		{"key3.ignore", 10, "key3.ignore", "ignored file"},
+		{"key4.bak", 10, "key4.bak", "excluded"},
+		{"large.pub", 100, "large.pub", "file too large: 100 bytes, max 50"},
+		{".git/key5.pub", 10, ".git", "hidden directory"},
+		{"revoked/key6.pub", 10, "revoked", "ignored by .keyignore"},
+		{"a/b/c/key7.pub", 10, "a/b/c", "max depth exceeded"},
+	}
+
+	for _, tt := range tests {
+		info := (&tar.Header{Name: tt.name, Size: tt.size, Mode: 0o644, Typeflag: tar.TypeReg}).FileInfo()
+
+		path, reason := f.Skip(tt.name, info)
+		if path != tt.wantPath || !strings.HasPrefix(reason, tt.want) {
+			t.Errorf("Skip(%s) = %q, %q, want %q, %q", tt.name, path, reason, tt.wantPath, tt.want)
+		}
+	}
+
+	// in non recursive mode the files in a directory are skipped with the directory
+	f, err = NewEntryFilter(Options{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := (&tar.Header{Name: "team-a/key2.pub", Size: 10, Mode: 0o644}).FileInfo()
+	if path, reason := f.Skip("team-a/key2.pub", info); path != "team-a" || reason != "directory" {
+		t.Errorf("Skip(team-a/key2.pub) = %q, %q, want the directory", path, reason)
+	}
+}
@@ -3,9 +3,11 @@ package keyfiles
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -54,39 +56,222 @@ func (f FileMetadatas) Hash() ([]byte, error) {
 	return hash.Sum(nil), nil
 }
 
+// DiffFiles compares two file lists by name, a file is modified if its size or modification time changed
+func DiffFiles(old, new FileMetadatas) (added, removed, modified []string) {
+	oldByName := make(map[string]FileMetadata, len(old))
+	for _, f := range old {
+		oldByName[f.Name] = f
+	}
+
+	newNames := make(map[string]bool, len(new))
+
+	for _, f := range new {
+		newNames[f.Name] = true
+
+		o, exists := oldByName[f.Name]
+
+		switch {
+		case !exists:
+			added = append(added, f.Name)
+		case o.Size != f.Size || !o.ModTime.Equal(f.ModTime):
+			modified = append(modified, f.Name)
+		}
+	}
+
+	for _, f := range old {
+		if !newNames[f.Name] {
+			removed = append(removed, f.Name)
+		}
+	}
+
+	return added, removed, modified
+}
+
+// Options controls which files are returned by GetFileMetadata
+type Options struct {
+	// descend into subdirectories, the file names are then relative paths with / as separator
+	Recursive bool
+
+	// the maximum depth of subdirectories to descend into in recursive mode, 0 for unlimited
+	MaxDepth int
+
+	// glob patterns, if not empty only the files matching at least one of them are returned
+	Include []string
+
+	// glob patterns, the files and directories matching any of them are skipped
+	Exclude []string
+
+	// optional gitignore style file in the directory with more patterns to skip
+	IgnoreFile string
+
+	// the files larger than this are skipped, 0 for unlimited
+	MaxFileSize int64
+
+	// skip the symlinks that resolve to a path outside the directory
+	NoExternalSymlinks bool
+
+	// skip the files that are writable by the group or by others
+	RejectWritable bool
+
+	// if not empty, skip the files not owned by one of these user ids (not supported on windows)
+	OwnerUIDs []int
+
+	// kubernetes AtomicWriter mode (secret and configmap volumes), the files are read from the
+	// directory the ..data symlink points to and the ..* entries are not reported as skipped
+	AtomicWriter bool
+}
+
+// atomicWriterDataDir is the symlink kubelet flips to publish a new version of a volume
+const atomicWriterDataDir = "..data"
+
+// ResolveDir returns the directory to read the files from
+// in AtomicWriter mode this is the timestamped directory ..data points to, if present,
+// reading all the files from it guarantees they belong to the same version of the volume
+func ResolveDir(dir string, opts Options) (string, error) {
+	if !opts.AtomicWriter {
+		return dir, nil
+	}
+
+	target, err := filepath.EvalSymlinks(filepath.Join(dir, atomicWriterDataDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return dir, nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("resolve %s: %w", atomicWriterDataDir, err)
+	}
+
+	return target, nil
+}
+
 // GetFileMetadata returns the metadata of all files in a directory
-// it skips directories, hidden and ignored files
+// it skips directories (unless in recursive mode), hidden and ignored files
 // if a symlink is encountered, the metadata of the target is returned
-func GetFileMetadata(dir string) (FileMetadatas, map[string]string, error) {
-	dirEntries, err := os.ReadDir(dir)
+// in AtomicWriter mode the files are listed from the directory returned by ResolveDir
+func GetFileMetadata(dir string, opts Options) (FileMetadatas, map[string]string, error) {
+	files := FileMetadatas{}
+	skipped := make(map[string]string)
+
+	dir, err := ResolveDir(dir, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	root, err := os.Stat(dir)
 	if err != nil {
 		return nil, nil, fmt.Errorf("read dir: %w", err)
 	}
 
-	files := make(FileMetadatas, 0, len(dirEntries))
-	skipped := make(map[string]string)
+	filter, err := newFilter(dir, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolve dir: %w", err)
+	}
+
+	w := &walker{
+		dir:     dir,
+		realDir: realDir,
+		opts:    opts,
+		filter:  filter,
+		files:   files,
+		skipped: skipped,
+	}
+
+	err = w.walk("", 0, []fs.FileInfo{root})
+
+	// return partial results on error
+	return w.files, w.skipped, err
+}
+
+// walker collects the file metadata of a directory
+type walker struct {
+	dir string
+
+	// dir with the symlinks resolved, used to check the symlink targets
+	realDir string
+
+	opts   Options
+	filter *filter
+
+	files   FileMetadatas
+	skipped map[string]string
+}
+
+// walk collects the metadata of the files in dir/rel,
+// parents holds the infos of the directories being walked and is used to detect symlink loops
+func (w *walker) walk(rel string, depth int, parents []fs.FileInfo) error {
+	dirEntries, err := os.ReadDir(filepath.Join(w.dir, filepath.FromSlash(rel)))
+	if err != nil {
+		return fmt.Errorf("read dir: %w", err)
+	}
 
 	for _, e := range dirEntries {
-		info, err := os.Stat(filepath.Join(dir, e.Name()))
+		name := path.Join(rel, e.Name())
+
+		if w.opts.AtomicWriter && rel == "" && strings.HasPrefix(e.Name(), "..") {
+			// kubelet internal entries, not interesting
+			continue
+		}
+
+		fullPath := filepath.Join(w.dir, filepath.FromSlash(name))
+
+		// the symlinks are checked before following them, a dangling one is skipped instead of failing the walk
+		if skip, reason := w.checkSymlink(fullPath, e); skip {
+			w.skipped[name] = reason
+			continue
+		}
+
+		info, err := os.Stat(fullPath)
 		if err != nil {
-			// return partial results
-			return files, skipped, fmt.Errorf("stat: %w", err)
+			return fmt.Errorf("stat: %w", err)
+		}
+
+		if info.IsDir() && w.opts.Recursive {
+			if skip, reason := skipDir(info, depth+1, parents, w.opts); skip {
+				w.skipped[name] = reason
+				continue
+			}
+
+			if skip, reason := w.filter.skip(name, true); skip {
+				w.skipped[name] = reason
+				continue
+			}
+
+			if err := w.walk(name, depth+1, append(parents, info)); err != nil {
+				return err
+			}
+
+			continue
 		}
 
 		if skip, reason := skipFile(info); skip {
-			skipped[e.Name()] = reason
+			w.skipped[name] = reason
+			continue
+		}
+
+		if skip, reason := w.filter.skip(name, false); skip {
+			w.skipped[name] = reason
+			continue
+		}
+
+		if skip, reason := checkFile(info, w.opts); skip {
+			w.skipped[name] = reason
 			continue
 		}
 
-		files = append(files, FileMetadata{
-			Name:    e.Name(),
+		w.files = append(w.files, FileMetadata{
+			Name:    name,
 			Size:    info.Size(),
 			ModTime: info.ModTime(),
 		})
 
 	}
 
-	return files, skipped, nil
+	return nil
 }
 
 func skipFile(fileInfo fs.FileInfo) (bool, string) {
@@ -94,13 +279,51 @@ func skipFile(fileInfo fs.FileInfo) (bool, string) {
 		return true, "directory"
 	}
 
-	if strings.HasPrefix(fileInfo.Name(), ".") {
+	return skipFileName(fileInfo.Name())
+}
+
+// skipFileName applies the name rules of skipFile
+func skipFileName(name string) (bool, string) {
+	if strings.HasPrefix(name, ".") {
 		return true, "hidden file"
 	}
 
-	if strings.HasSuffix(fileInfo.Name(), ".ignore") {
+	if strings.HasSuffix(name, ".ignore") {
 		return true, "ignored file"
 	}
 
 	return false, ""
 }
+
+// skipDir decides if a directory is descended into in recursive mode
+// hidden directories are always skipped, this includes the ..data and ..timestamp directories of kubernetes volumes
+func skipDir(dirInfo fs.FileInfo, depth int, parents []fs.FileInfo, opts Options) (bool, string) {
+	if skip, reason := skipDirName(dirInfo.Name(), depth, opts); skip {
+		return true, reason
+	}
+
+	for _, p := range parents {
+		if os.SameFile(p, dirInfo) {
+			return true, "directory loop"
+		}
+	}
+
+	return false, ""
+}
+
+// skipDirName applies the name and depth rules of skipDir
+func skipDirName(name string, depth int, opts Options) (bool, string) {
+	if strings.HasPrefix(name, ".") {
+		return true, "hidden directory"
+	}
+
+	if strings.HasSuffix(name, ".ignore") {
+		return true, "ignored directory"
+	}
+
+	if opts.MaxDepth > 0 && depth > opts.MaxDepth {
+		return true, "max depth exceeded"
+	}
+
+	return false, ""
+}
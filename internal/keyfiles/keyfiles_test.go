@@ -13,7 +13,8 @@ import (
 
 func TestGetFileMetadata(t *testing.T) {
 	type args struct {
-		dir string
+		dir  string
+		opts Options
 	}
 
 	// using to generate predictable mod times for files
@@ -29,7 +30,7 @@ func TestGetFileMetadata(t *testing.T) {
 		{
 			name: "non-existent dir",
 			argsFunc: func(string) (*args, error) {
-				return &args{os.TempDir() + "/TestGetFileMetadata-baddir-not-exist-1023727892"}, nil
+				return &args{dir: os.TempDir() + "/TestGetFileMetadata-baddir-not-exist-1023727892"}, nil
 			},
 			wantErr: true,
 		},
@@ -41,7 +42,7 @@ func TestGetFileMetadata(t *testing.T) {
 					return nil, err
 				}
 
-				return &args{dir}, nil
+				return &args{dir: dir}, nil
 			},
 			want:  FileMetadatas{},
 			want1: map[string]string{},
@@ -67,7 +68,7 @@ func TestGetFileMetadata(t *testing.T) {
 					return nil, err
 				}
 
-				return &args{dir}, nil
+				return &args{dir: dir}, nil
 			},
 			want: FileMetadatas{},
 			want1: map[string]string{
@@ -99,7 +100,7 @@ func TestGetFileMetadata(t *testing.T) {
 					return nil, err
 				}
 
-				return &args{dir}, nil
+				return &args{dir: dir}, nil
 			},
 			want: FileMetadatas{
 				FileMetadata{"key1", 9, testTime.Add(1 * time.Second)},
@@ -111,6 +112,235 @@ func TestGetFileMetadata(t *testing.T) {
 				"file.ignore":  "ignored file",
 			},
 		},
+		{
+			name: "recursive",
+			argsFunc: func(name string) (*args, error) {
+				dir, err := mkTmpDir(t.Name(), name)
+				if err != nil {
+					return nil, fmt.Errorf("mkTmpDir: %w", err)
+				}
+
+				for _, d := range []string{"/..2024_06_05_16_49_04.104114561", "/team-a/deep/deeper"} {
+					if err := os.MkdirAll(dir+d, 0700); err != nil {
+						return nil, fmt.Errorf("os.MkdirAll: %w", err)
+					}
+				}
+
+				if err := os.Symlink("..2024_06_05_16_49_04.104114561", dir+"/..data"); err != nil {
+					return nil, fmt.Errorf("os.Symlink: %w", err)
+				}
+
+				files := map[string]createFile{
+					"..2024_06_05_16_49_04.104114561/key0": {"key0 data", testTime},
+					"key1":                                 {"key1 data", testTime.Add(1 * time.Second)},
+					"team-a/key2":                          {"key2 data2", testTime.Add(2 * time.Second)},
+					"team-a/deep/key3":                     {"key3 data33", testTime.Add(3 * time.Second)},
+					"team-a/deep/deeper/key4":              {"key4", testTime.Add(4 * time.Second)},
+				}
+
+				if err := createFiles(dir, files); err != nil {
+					return nil, err
+				}
+
+				return &args{dir: dir, opts: Options{Recursive: true, MaxDepth: 2}}, nil
+			},
+			want: FileMetadatas{
+				FileMetadata{"key1", 9, testTime.Add(1 * time.Second)},
+				FileMetadata{"team-a/deep/key3", 11, testTime.Add(3 * time.Second)},
+				FileMetadata{"team-a/key2", 10, testTime.Add(2 * time.Second)},
+			},
+			want1: map[string]string{
+				"..2024_06_05_16_49_04.104114561": "hidden directory",
+				"..data":                          "hidden directory",
+				"team-a/deep/deeper":              "max depth exceeded",
+			},
+		},
+		{
+			name: "atomic writer",
+			argsFunc: func(name string) (*args, error) {
+				dir, err := mkTmpDir(t.Name(), name)
+				if err != nil {
+					return nil, fmt.Errorf("mkTmpDir: %w", err)
+				}
+
+				// the layout kubelet creates for secret volumes
+				for _, d := range []string{"/..2024_06_05_16_49_04.104114561", "/..2024_06_05_16_50_04.204114561"} {
+					if err := os.Mkdir(dir+d, 0700); err != nil {
+						return nil, fmt.Errorf("os.Mkdir: %w", err)
+					}
+				}
+
+				files := map[string]createFile{
+					"..2024_06_05_16_49_04.104114561/key1": {"old key1", testTime},
+					"..2024_06_05_16_50_04.204114561/key1": {"key1 data", testTime.Add(1 * time.Second)},
+					"..2024_06_05_16_50_04.204114561/key2": {"key2 data2", testTime.Add(2 * time.Second)},
+				}
+
+				if err := createFiles(dir, files); err != nil {
+					return nil, err
+				}
+
+				symlinks := map[string]string{
+					"..data": "..2024_06_05_16_50_04.204114561",
+					"key1":   "..data/key1",
+					"key2":   "..data/key2",
+				}
+
+				for name, target := range symlinks {
+					if err := os.Symlink(target, dir+"/"+name); err != nil {
+						return nil, fmt.Errorf("os.Symlink: %w", err)
+					}
+				}
+
+				return &args{dir: dir, opts: Options{AtomicWriter: true}}, nil
+			},
+			want: FileMetadatas{
+				FileMetadata{"key1", 9, testTime.Add(1 * time.Second)},
+				FileMetadata{"key2", 10, testTime.Add(2 * time.Second)},
+			},
+			want1: map[string]string{},
+		},
+		{
+			name: "safety checks",
+			argsFunc: func(name string) (*args, error) {
+				dir, err := mkTmpDir(t.Name(), name)
+				if err != nil {
+					return nil, fmt.Errorf("mkTmpDir: %w", err)
+				}
+
+				files := map[string]createFile{
+					"key1":     {"key1 data", testTime.Add(1 * time.Second)},
+					"large":    {"this file is too large", testTime},
+					"writable": {"writable", testTime},
+				}
+
+				if err := createFiles(dir, files); err != nil {
+					return nil, err
+				}
+
+				if err := os.Chmod(dir+"/writable", 0666); err != nil {
+					return nil, fmt.Errorf("os.Chmod: %w", err)
+				}
+
+				if err := os.Symlink("key1", dir+"/internal-link"); err != nil {
+					return nil, fmt.Errorf("os.Symlink: %w", err)
+				}
+
+				if err := os.Symlink("/dev/null", dir+"/external-link"); err != nil {
+					return nil, fmt.Errorf("os.Symlink: %w", err)
+				}
+
+				if err := os.Symlink("missing", dir+"/dangling-link"); err != nil {
+					return nil, fmt.Errorf("os.Symlink: %w", err)
+				}
+
+				opts := Options{
+					MaxFileSize:        10,
+					NoExternalSymlinks: true,
+					RejectWritable:     true,
+					OwnerUIDs:          []int{os.Getuid()},
+				}
+
+				return &args{dir: dir, opts: opts}, nil
+			},
+			want: FileMetadatas{
+				FileMetadata{"internal-link", 9, testTime.Add(1 * time.Second)},
+				FileMetadata{"key1", 9, testTime.Add(1 * time.Second)},
+			},
+			want1: map[string]string{
+				"dangling-link": "dangling symlink",
+				"external-link": "symlink points outside the key directory: /dev/null",
+				"large":         "file too large: 22 bytes, max 10",
+				"writable":      "file is group or world writable: -rw-rw-rw-",
+			},
+		},
+		{
+			name: "dangling symlinks",
+			argsFunc: func(name string) (*args, error) {
+				dir, err := mkTmpDir(t.Name(), name)
+				if err != nil {
+					return nil, fmt.Errorf("mkTmpDir: %w", err)
+				}
+
+				files := map[string]createFile{
+					"key1": {"key1 data", testTime.Add(1 * time.Second)},
+				}
+
+				if err := createFiles(dir, files); err != nil {
+					return nil, err
+				}
+
+				for _, link := range []string{"dangling-key", "dangling-dir"} {
+					if err := os.Symlink("missing", dir+"/"+link); err != nil {
+						return nil, fmt.Errorf("os.Symlink: %w", err)
+					}
+				}
+
+				return &args{dir: dir, opts: Options{Recursive: true}}, nil
+			},
+			want: FileMetadatas{
+				FileMetadata{"key1", 9, testTime.Add(1 * time.Second)},
+			},
+			want1: map[string]string{
+				"dangling-key": "dangling symlink",
+				"dangling-dir": "dangling symlink",
+			},
+		},
+		{
+			name: "patterns and ignore file",
+			argsFunc: func(name string) (*args, error) {
+				dir, err := mkTmpDir(t.Name(), name)
+				if err != nil {
+					return nil, fmt.Errorf("mkTmpDir: %w", err)
+				}
+
+				for _, d := range []string{"/docs", "/team-a"} {
+					if err := os.Mkdir(dir+d, 0700); err != nil {
+						return nil, fmt.Errorf("os.Mkdir: %w", err)
+					}
+				}
+
+				files := map[string]createFile{
+					".jwksignore":      {"# comments are skipped\nREADME*\ndocs/\n*.crt\n!keep.crt\n", testTime},
+					"README.md":        {"readme", testTime},
+					"ca-bundle.crt":    {"bundle", testTime},
+					"keep.crt":         {"keep", testTime},
+					"key1.pub":         {"key1 data", testTime.Add(1 * time.Second)},
+					"notes.txt":        {"notes", testTime},
+					"docs/key.pub":     {"docs", testTime},
+					"team-a/key2.pub":  {"key2 data2", testTime.Add(2 * time.Second)},
+					"team-a/old.pub":   {"old", testTime},
+					"team-a/README.md": {"readme", testTime},
+				}
+
+				if err := createFiles(dir, files); err != nil {
+					return nil, err
+				}
+
+				opts := Options{
+					Recursive:  true,
+					Include:    []string{"*.pub"},
+					Exclude:    []string{"team-a/old*"},
+					IgnoreFile: ".jwksignore",
+				}
+
+				return &args{dir: dir, opts: opts}, nil
+			},
+			want: FileMetadatas{
+				FileMetadata{"key1.pub", 9, testTime.Add(1 * time.Second)},
+				FileMetadata{"team-a/key2.pub", 10, testTime.Add(2 * time.Second)},
+			},
+			want1: map[string]string{
+				".jwksignore":      "hidden file",
+				"README.md":        "ignored by .jwksignore pattern 'README*'",
+				"ca-bundle.crt":    "ignored by .jwksignore pattern '*.crt'",
+				"keep.crt":         "not matched by include patterns",
+				"notes.txt":        "not matched by include patterns",
+				"docs":             "ignored by .jwksignore pattern 'docs'",
+				"team-a/old.pub":   "excluded by pattern 'team-a/old*'",
+				"team-a/README.md": "ignored by .jwksignore pattern 'README*'",
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -143,7 +373,7 @@ func TestGetFileMetadata(t *testing.T) {
 				t.Logf("cleaned up the test path at '%s'", dirToClean)
 			})
 
-			got, got1, err := GetFileMetadata(args.dir)
+			got, got1, err := GetFileMetadata(args.dir, args.opts)
 			if (err != nil) != tt.wantErr {
 				doCleanup = false
 				t.Errorf("GetFileMetadata() error = %v, wantErr %v", err, tt.wantErr)
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package keyfiles
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileOwner returns the user id owning the file
+func fileOwner(info fs.FileInfo) (int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return int(stat.Uid), true
+}
@@ -0,0 +1,8 @@
+package keyfiles
+
+import "io/fs"
+
+// fileOwner is not supported on windows
+func fileOwner(info fs.FileInfo) (int, bool) {
+	return 0, false
+}
@@ -0,0 +1,69 @@
+package keyfiles
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// checkSymlink skips the symlinks that can not be resolved, and the ones resolving outside the directory
+// if NoExternalSymlinks is set
+func (w *walker) checkSymlink(fullPath string, entry fs.DirEntry) (bool, string) {
+	if entry.Type()&fs.ModeSymlink == 0 {
+		return false, ""
+	}
+
+	target, err := filepath.EvalSymlinks(fullPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, "dangling symlink"
+	}
+
+	if err != nil {
+		return true, fmt.Sprintf("can not resolve symlink: %s", err)
+	}
+
+	if !w.opts.NoExternalSymlinks {
+		return false, ""
+	}
+
+	rel, err := filepath.Rel(w.realDir, target)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return true, fmt.Sprintf("symlink points outside the key directory: %s", target)
+	}
+
+	return false, ""
+}
+
+// checkFile applies the size, permission and owner checks to a file that is about to be loaded
+func checkFile(info fs.FileInfo, opts Options) (bool, string) {
+	if opts.MaxFileSize > 0 && info.Size() > opts.MaxFileSize {
+		return true, fmt.Sprintf("file too large: %d bytes, max %d", info.Size(), opts.MaxFileSize)
+	}
+
+	if opts.RejectWritable && info.Mode().Perm()&0o022 != 0 {
+		return true, fmt.Sprintf("file is group or world writable: %s", info.Mode().Perm())
+	}
+
+	if len(opts.OwnerUIDs) > 0 {
+		uid, ok := fileOwner(info)
+		if !ok {
+			return true, "file owner is not available"
+		}
+
+		allowed := false
+		for _, u := range opts.OwnerUIDs {
+			if u == uid {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return true, fmt.Sprintf("file owned by unexpected uid %d", uid)
+		}
+	}
+
+	return false, ""
+}
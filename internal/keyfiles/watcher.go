@@ -4,6 +4,10 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,11 +15,40 @@ type WatcherEvent struct {
 	Files   FileMetadatas
 	Skipped map[string]string
 	Error   error
+
+	// the number of consecutive failed checks, set on error events
+	Failures int
+
+	// Forced is set when the event was caused by touching the trigger file
+	Forced bool
+
+	// the names of the files that changed since the previous event
+	Added    []string
+	Removed  []string
+	Modified []string
 }
 
 type Watcher struct {
 	Events <-chan WatcherEvent
 	events chan<- WatcherEvent
+
+	// Options are passed to GetFileMetadata
+	Options Options
+
+	// TriggerFile is an optional file name in the watched directory,
+	// changing its modification time forces an event even if no key file has changed
+	TriggerFile string
+
+	// Jitter randomizes every polling interval by up to this fraction of it (0.1 means +/-10%),
+	// so many replicas do not poll a shared volume in lockstep
+	Jitter float64
+
+	// MaxBackoff is the maximum polling interval while the directory is in error,
+	// the interval doubles on every consecutive failure, 0 disables the backoff
+	MaxBackoff time.Duration
+
+	// the number of consecutive failed checks, accessed atomically
+	failures int64
 }
 
 func NewWatcher() *Watcher {
@@ -29,6 +62,11 @@ func NewWatcher() *Watcher {
 	return w
 }
 
+// Failures returns the number of consecutive failed checks, it is reset by a successful check
+func (w *Watcher) Failures() int {
+	return int(atomic.LoadInt64(&w.failures))
+}
+
 func (w *Watcher) Watch(ctx context.Context, dir string, interval time.Duration) error {
 	if interval <= 0 {
 		return errors.New("watcher can not be started with interval <= 0")
@@ -36,58 +74,115 @@ func (w *Watcher) Watch(ctx context.Context, dir string, interval time.Duration)
 
 	defer close(w.events)
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	oldHash := []byte{}
 	oldErrStr := ""
+	oldFiles := FileMetadatas{}
+	oldTrigger := w.triggerModTime(dir)
 
 	check := func() {
-		files, skipped, err := GetFileMetadata(dir)
+		// the trigger is acknowledged only by a successful listing, a touch during an error state is not lost
+		trigger := w.triggerModTime(dir)
+		forced := !trigger.Equal(oldTrigger) && !trigger.IsZero()
 
-		if err != nil && err.Error() == oldErrStr {
-			// have error, but it's the same as last time
-			return
-		}
+		files, skipped, err := GetFileMetadata(dir, w.Options)
 
-		hash, err := files.Hash()
-		if err != nil && err.Error() == oldErrStr {
-			// have error, but it's the same as last time
-			return
+		var hash []byte
+		if err == nil {
+			hash, err = files.Hash()
 		}
 
-		oldErrStr = ""
-
 		if err != nil {
+			failures := atomic.AddInt64(&w.failures, 1)
+
+			if err.Error() == oldErrStr {
+				// have error, but it's the same as last time
+				return
+			}
+
 			oldErrStr = err.Error()
 			oldHash = nil
-		} else {
-			oldErrStr = ""
-			if bytes.Equal(hash, oldHash) {
-				// no changes
-				return
+
+			w.events <- WatcherEvent{
+				Files:    files,
+				Skipped:  skipped,
+				Error:    err,
+				Failures: int(failures),
 			}
+
+			return
+		}
+
+		atomic.StoreInt64(&w.failures, 0)
+		oldErrStr = ""
+		oldTrigger = trigger
+
+		if bytes.Equal(hash, oldHash) && !forced {
+			// no changes
+			return
 		}
 
 		oldHash = hash
 
-		w.events <- WatcherEvent{
+		event := WatcherEvent{
 			Files:   files,
 			Skipped: skipped,
-			Error:   err,
+			Forced:  forced,
 		}
-	}
 
-	check()
+		event.Added, event.Removed, event.Modified = DiffFiles(oldFiles, files)
+		oldFiles = files
+
+		w.events <- event
+	}
 
 	for {
+		check()
+
+		timer := time.NewTimer(w.nextInterval(interval, w.Failures(), rnd.Float64()))
+
 		select {
 		case <-ctx.Done():
+			timer.Stop()
 			return nil
 
-		case <-ticker.C:
-			check()
+		case <-timer.C:
 		}
 	}
+}
+
+// nextInterval returns the time to wait before the next check,
+// random is a number in [0, 1) used to apply the jitter
+func (w *Watcher) nextInterval(interval time.Duration, failures int, random float64) time.Duration {
+	next := interval
+
+	for i := 0; i < failures && next < w.MaxBackoff; i++ {
+		next *= 2
+	}
+
+	if w.MaxBackoff > interval && next > w.MaxBackoff {
+		next = w.MaxBackoff
+	}
+
+	if w.Jitter > 0 {
+		next += time.Duration(float64(next) * w.Jitter * (2*random - 1))
+	}
+
+	return next
+}
+
+// triggerModTime returns the modification time of the trigger file,
+// zero time is returned if the trigger file is not configured or does not exist
+func (w *Watcher) triggerModTime(dir string) time.Time {
+	if w.TriggerFile == "" {
+		return time.Time{}
+	}
+
+	info, err := os.Stat(filepath.Join(dir, w.TriggerFile))
+	if err != nil {
+		return time.Time{}
+	}
 
+	return info.ModTime()
 }
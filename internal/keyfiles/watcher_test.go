@@ -0,0 +1,195 @@
+package keyfiles
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcherNextInterval(t *testing.T) {
+	tests := []struct {
+		name       string
+		jitter     float64
+		maxBackoff time.Duration
+		failures   int
+		random     float64
+		want       time.Duration
+	}{
+		{"no failures", 0, time.Minute, 0, 0, time.Second},
+		{"backoff", 0, time.Minute, 3, 0, 8 * time.Second},
+		{"backoff capped", 0, time.Minute, 10, 0, time.Minute},
+		{"backoff disabled", 0, 0, 10, 0, time.Second},
+		{"jitter low", 0.1, time.Minute, 0, 0, 900 * time.Millisecond},
+		{"jitter high", 0.1, time.Minute, 0, 1, 1100 * time.Millisecond},
+		{"jitter on backoff", 0.5, time.Minute, 1, 0.75, 2500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWatcher()
+			w.Jitter = tt.jitter
+			w.MaxBackoff = tt.maxBackoff
+
+			if got := w.nextInterval(time.Second, tt.failures, tt.random); got != tt.want {
+				t.Errorf("nextInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// nextEvent returns the next event of the watcher, failing the test if none comes in time
+func nextEvent(t *testing.T, w *Watcher) WatcherEvent {
+	t.Helper()
+
+	select {
+	case event := <-w.Events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("no watcher event")
+	}
+
+	return WatcherEvent{}
+}
+
+func TestWatcherTriggerFile(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "key1.pub"), []byte("key1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := NewWatcher()
+	w.TriggerFile = ".reload"
+
+	go w.Watch(ctx, dir, 10*time.Millisecond) // nolint:errcheck
+
+	if event := nextEvent(t, w); event.Forced || event.Error != nil {
+		t.Fatalf("first event = %+v, want the initial listing", event)
+	}
+
+	// the trigger file is hidden, the metadata hash of the key files does not change
+	trigger := filepath.Join(dir, ".reload")
+	if err := os.WriteFile(trigger, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	event := nextEvent(t, w)
+	if !event.Forced || len(event.Added)+len(event.Removed)+len(event.Modified) > 0 {
+		t.Errorf("event = %+v, want a forced event without changes", event)
+	}
+
+	// touching it again forces another event
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(trigger, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	if event := nextEvent(t, w); !event.Forced {
+		t.Errorf("event = %+v, want a forced event", event)
+	}
+}
+
+func TestWatcherTriggerFileDuringError(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "key1.pub"), []byte("key1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := NewWatcher()
+	w.TriggerFile = ".reload"
+	w.Options.IgnoreFile = ".jwksignore"
+
+	go w.Watch(ctx, dir, 10*time.Millisecond) // nolint:errcheck
+
+	if event := nextEvent(t, w); event.Forced || event.Error != nil {
+		t.Fatalf("first event = %+v, want the initial listing", event)
+	}
+
+	// an ignore file that can not be read fails the listing
+	ignoreFile := filepath.Join(dir, ".jwksignore")
+	if err := os.Mkdir(ignoreFile, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if event := nextEvent(t, w); event.Error == nil {
+		t.Fatalf("event = %+v, want the listing error", event)
+	}
+
+	// the trigger is touched while the listing fails, the forced event follows the recovery
+	if err := os.WriteFile(filepath.Join(dir, ".reload"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if err := os.Remove(ignoreFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if event := nextEvent(t, w); !event.Forced || event.Error != nil {
+		t.Errorf("event = %+v, want a forced event after the recovery", event)
+	}
+}
+
+func TestWatcherBackoff(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "keys")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := NewWatcher()
+	w.MaxBackoff = 160 * time.Millisecond
+
+	events := make(chan WatcherEvent, 100)
+	go func() {
+		for event := range w.Events {
+			events <- event
+		}
+	}()
+
+	go w.Watch(ctx, dir, 10*time.Millisecond) // nolint:errcheck
+
+	// the missing directory fails every check, the interval doubles: checks at 0, 10, 30, 70 and 150ms,
+	// instead of 25 checks at a fixed interval
+	time.Sleep(250 * time.Millisecond)
+
+	if failures := w.Failures(); failures < 2 || failures > 8 {
+		t.Errorf("failures = %d after 250ms, want the interval to grow", failures)
+	}
+
+	if event := <-events; event.Error == nil || event.Failures != 1 {
+		t.Errorf("first event = %+v, want the first failure", event)
+	}
+
+	// one successful check resets the failures
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		select {
+		case event := <-events:
+			if event.Error != nil {
+				continue
+			}
+
+			if failures := w.Failures(); failures != 0 {
+				t.Errorf("failures = %d after a successful check, want 0", failures)
+			}
+
+			return
+
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event after the directory was created")
+		}
+	}
+}
@@ -2,32 +2,274 @@ package keyloader
 
 import (
 	"errors"
+	"fmt"
+	"go-jwks-server/internal/keyfiles"
+	"go-jwks-server/internal/keysource"
+	"net/url"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
 type Config struct {
-	// the directory to load the keys from
-	Dir string
+	// the directories to load the keys from, on key id conflicts the directory listed first takes precedence
+	Dirs []string
+
+	// controls how the files are listed in Dirs
+	Files keyfiles.Options
+
+	// joins the path elements of a file in a subdirectory to form the key id (recursive mode only)
+	KidPathSeparator string
 
 	// set to 0 to disable watching
 	WatchInterval time.Duration
 
+	// randomizes the watch interval by up to this fraction of it
+	WatchJitter float64
+
+	// the maximum watch interval while a directory is in error, 0 disables the backoff
+	WatchMaxBackoff time.Duration
+
 	// fail on error, actually return the error, otherwise just log it
 	FailOnError bool
+
+	// optional hidden file in every directory, touching it forces a reload of the keys, empty to disable
+	ReloadTriggerFile string
+
+	// bundle files (JWKS JSON or PEM blocks) to load the keys from, watched with WatchInterval
+	KeyFiles []string
+
+	// tar, tar.gz or zip archives with one key in a file, the entries are filtered with Files, watched with WatchInterval
+	KeyArchives []string
+
+	// YAML or JSON file listing the keys with their metadata, watched with WatchInterval, see keysource.Manifest
+	KeyManifest string
+
+	// the PEM or JWK material of the keys given in the configuration, by key id, not printed with the config
+	InlineKeys map[string]string `json:"-"`
+
+	// upstream JWKS URLs merged into the published keys, after the local keys
+	RemoteJWKS []string
+
+	// controls how the upstream JWKS URLs and the OpenID Connect issuers are fetched
+	Remote keysource.RemoteConfig
+
+	// OpenID Connect issuer URLs, optionally as alias=url, the keys of an issuer with an alias
+	// get the key id prefix alias followed by OIDCKidSeparator
+	OIDCIssuers []string
+
+	// how often the discovery documents of the issuers are resolved again
+	OIDCDiscoveryInterval time.Duration
+
+	// separates the issuer alias from the key id
+	OIDCKidSeparator string
+
+	// the bucket to load the keys from, disabled if no bucket is set, KidPathSeparator and
+	// Files.MaxFileSize apply to the objects
+	S3 keysource.S3Config
+
+	// the repository to load the keys from, disabled if no repository is set, KidPathSeparator and
+	// Files.MaxFileSize apply to the files
+	Git keysource.GitConfig
+
+	// the Secrets and ConfigMaps to load the keys from, disabled if no label selector is set
+	Kubernetes keysource.KubernetesConfig
+
+	// the etcd cluster to load the keys from, disabled if no endpoint is set, KidPathSeparator and
+	// Files.MaxFileSize apply to the values
+	Etcd keysource.EtcdConfig
+
+	// the transit keys to publish, disabled if no key is set
+	Vault keysource.VaultConfig
+
+	// the KMS signing keys to publish, disabled if no key id or alias prefix is set
+	KMS keysource.KMSConfig
+
+	// the database to load the keys from, disabled if no data source name is set
+	SQL keysource.SQLConfig
+
+	// caps the number of published keys, disabled if MaxKeys is 0
+	Selection SelectionConfig
 }
 
 // NewConfig creates a new config with default values
 func NewConfig() Config {
 	return Config{
-		Dir:           "./keys",
-		WatchInterval: 1 * time.Second,
-		FailOnError:   false,
+		Dirs:            []string{"./keys"},
+		WatchInterval:   1 * time.Second,
+		WatchJitter:     0.1,
+		WatchMaxBackoff: 1 * time.Minute,
+		FailOnError:     false,
+		Files: keyfiles.Options{
+			Recursive:   false,
+			MaxDepth:    5,
+			IgnoreFile:  ".jwksignore",
+			MaxFileSize: 1024 * 1024,
+		},
+		KidPathSeparator: "/",
+		Remote: keysource.RemoteConfig{
+			Timeout:            10 * time.Second,
+			RefreshInterval:    5 * time.Minute,
+			MinRefreshInterval: 30 * time.Second,
+			MaxRefreshInterval: 1 * time.Hour,
+			MaxStale:           24 * time.Hour,
+		},
+		OIDCDiscoveryInterval: 1 * time.Hour,
+		OIDCKidSeparator:      ":",
+		S3: keysource.S3Config{
+			Region:       "us-east-1",
+			PollInterval: 30 * time.Second,
+		},
+		Git:        keysource.NewGitConfig(),
+		Kubernetes: keysource.NewKubernetesConfig(),
+		Etcd:       keysource.NewEtcdConfig(),
+		Vault:      keysource.NewVaultConfig(),
+		KMS:        keysource.NewKMSConfig(),
+		SQL:        keysource.NewSQLConfig(),
+		Selection:  SelectionConfig{OrderBy: "mtime"},
 	}
 }
 
 func (c *Config) Validate() error {
-	if c.Dir == "" {
-		return errors.New("key-dir is required")
+	seen := map[string]bool{}
+	for _, d := range c.Dirs {
+		if d == "" {
+			return errors.New("key-dir must not be empty")
+		}
+
+		if seen[filepath.Clean(d)] {
+			return fmt.Errorf("key-dir %s is provided more than once", d)
+		}
+
+		seen[filepath.Clean(d)] = true
+	}
+
+	for _, f := range c.KeyFiles {
+		if f == "" {
+			return errors.New("key-file must not be empty")
+		}
+	}
+
+	for _, a := range c.KeyArchives {
+		if a == "" {
+			return errors.New("key-archive must not be empty")
+		}
+	}
+
+	for kid, material := range c.InlineKeys {
+		if kid == "" || material == "" {
+			return errors.New("inline keys must have a key id and key material")
+		}
+	}
+
+	seen = map[string]bool{}
+	for _, u := range c.RemoteJWKS {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("remote-jwks-url %s must be an absolute http or https url", u)
+		}
+
+		if seen[u] {
+			return fmt.Errorf("remote-jwks-url %s is provided more than once", u)
+		}
+
+		seen[u] = true
+	}
+
+	seen = map[string]bool{}
+	for _, i := range c.OIDCIssuers {
+		alias, issuer := parseIssuer(i)
+
+		parsed, err := url.Parse(issuer)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("oidc-issuer %s must be an absolute http or https url", issuer)
+		}
+
+		if seen[issuer] {
+			return fmt.Errorf("oidc-issuer %s is provided more than once", issuer)
+		}
+
+		seen[issuer] = true
+
+		if alias != "" && seen["alias:"+alias] {
+			return fmt.Errorf("oidc-issuer alias %s is used more than once", alias)
+		}
+
+		seen["alias:"+alias] = true
+	}
+
+	if c.OIDCDiscoveryInterval < 0 {
+		return errors.New("oidc-discovery-interval must not be negative")
+	}
+
+	if err := c.SQL.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Etcd.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Vault.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.KMS.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Git.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Kubernetes.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.S3.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Remote.Validate(); err != nil {
+		return err
+	}
+
+	if err := c.Selection.Validate(); err != nil {
+		return err
+	}
+
+	if c.Files.MaxDepth < 0 {
+		return errors.New("key-dir-max-depth must not be negative")
+	}
+
+	if c.WatchJitter < 0 || c.WatchJitter >= 1 {
+		return errors.New("dir-watch-jitter must be in the range [0, 1)")
+	}
+
+	if c.WatchMaxBackoff < 0 {
+		return errors.New("dir-watch-max-backoff must not be negative")
+	}
+
+	if c.Files.MaxFileSize < 0 {
+		return errors.New("key-max-file-size must not be negative")
+	}
+
+	if c.Files.Recursive && c.KidPathSeparator == "" {
+		return errors.New("key-id-path-separator is required in recursive mode")
+	}
+
+	if strings.ContainsAny(c.Files.IgnoreFile, `/\`) {
+		return errors.New("key-ignore-file must be a file name, not a path")
+	}
+
+	if c.ReloadTriggerFile != "" {
+		if !strings.HasPrefix(c.ReloadTriggerFile, ".") {
+			return errors.New("reload-trigger-file must be a hidden file (start with a dot)")
+		}
+
+		if strings.ContainsAny(c.ReloadTriggerFile, `/\`) {
+			return errors.New("reload-trigger-file must be a file name, not a path")
+		}
 	}
 
 	return nil
@@ -36,3 +278,160 @@ func (c *Config) Validate() error {
 func (c *Config) WatchOn() bool {
 	return c.WatchInterval > 0
 }
+
+// HasExtraSources returns true if a key source other than the key directories is configured
+func (c *Config) HasExtraSources() bool {
+	return len(c.KeyFiles) > 0 || len(c.KeyArchives) > 0 || c.KeyManifest != "" || len(c.InlineKeys) > 0 || len(c.RemoteJWKS) > 0 || len(c.OIDCIssuers) > 0 || c.S3.Enabled() || c.Git.Enabled() || c.Kubernetes.Enabled() || c.Etcd.Enabled() || c.Vault.Enabled() || c.KMS.Enabled() || c.SQL.Enabled()
+}
+
+// parseIssuer splits an oidc-issuer value into the optional alias and the issuer url
+func parseIssuer(value string) (string, string) {
+	alias, issuer, found := strings.Cut(value, "=")
+	if !found || strings.Contains(alias, "://") {
+		return "", value
+	}
+
+	return alias, issuer
+}
+
+// sources creates the configured key sources in the order of precedence:
+// the key directories, the key files, the key archives, the key manifest, the inline keys, the git repository, the Kubernetes objects, the etcd prefix, the Vault transit keys, the KMS keys, the database,
+// the bucket, the upstream JWKS URLs and the OpenID Connect issuers
+func (c *Config) sources() ([]keysource.KeySource, error) {
+	dirConfig := keysource.DirConfig{
+		Files:             c.Files,
+		KidPathSeparator:  c.KidPathSeparator,
+		WatchInterval:     c.WatchInterval,
+		WatchJitter:       c.WatchJitter,
+		WatchMaxBackoff:   c.WatchMaxBackoff,
+		ReloadTriggerFile: c.ReloadTriggerFile,
+	}
+
+	var sources []keysource.KeySource
+
+	for _, d := range c.Dirs {
+		sources = append(sources, keysource.NewDir(d, dirConfig))
+	}
+
+	for _, f := range c.KeyFiles {
+		sources = append(sources, keysource.NewFile(f, c.WatchInterval))
+	}
+
+	archiveConfig := keysource.ArchiveConfig{
+		Files:            c.Files,
+		KidPathSeparator: c.KidPathSeparator,
+		WatchInterval:    c.WatchInterval,
+	}
+
+	for _, a := range c.KeyArchives {
+		sources = append(sources, keysource.NewArchive(a, archiveConfig))
+	}
+
+	if c.KeyManifest != "" {
+		sources = append(sources, keysource.NewManifest(c.KeyManifest, c.WatchInterval))
+	}
+
+	if len(c.InlineKeys) > 0 {
+		sources = append(sources, keysource.NewInline(c.InlineKeys))
+	}
+
+	if c.Git.Enabled() {
+		gitConfig := c.Git
+		gitConfig.KidPathSeparator = c.KidPathSeparator
+		gitConfig.MaxFileSize = c.Files.MaxFileSize
+
+		git, err := keysource.NewGit(gitConfig)
+		if err != nil {
+			return nil, fmt.Errorf("creating the git source: %w", err)
+		}
+
+		sources = append(sources, git)
+	}
+
+	if c.Kubernetes.Enabled() {
+		kube, err := keysource.NewKubernetes(c.Kubernetes)
+		if err != nil {
+			return nil, fmt.Errorf("creating the kubernetes source: %w", err)
+		}
+
+		sources = append(sources, kube)
+	}
+
+	if c.Etcd.Enabled() {
+		etcdConfig := c.Etcd
+		etcdConfig.KidPathSeparator = c.KidPathSeparator
+		etcdConfig.MaxValueSize = c.Files.MaxFileSize
+
+		etcd, err := keysource.NewEtcd(etcdConfig)
+		if err != nil {
+			return nil, fmt.Errorf("creating the etcd source: %w", err)
+		}
+
+		sources = append(sources, etcd)
+	}
+
+	if c.Vault.Enabled() {
+		vault, err := keysource.NewVault(c.Vault)
+		if err != nil {
+			return nil, fmt.Errorf("creating the vault source: %w", err)
+		}
+
+		sources = append(sources, vault)
+	}
+
+	if c.KMS.Enabled() {
+		kms, err := keysource.NewKMS(c.KMS)
+		if err != nil {
+			return nil, fmt.Errorf("creating the kms source: %w", err)
+		}
+
+		sources = append(sources, kms)
+	}
+
+	if c.SQL.Enabled() {
+		db, err := keysource.NewSQL(c.SQL)
+		if err != nil {
+			return nil, fmt.Errorf("creating the sql source: %w", err)
+		}
+
+		sources = append(sources, db)
+	}
+
+	if len(c.RemoteJWKS) == 0 && len(c.OIDCIssuers) == 0 && !c.S3.Enabled() {
+		return sources, nil
+	}
+
+	client, err := keysource.NewHTTPClient(c.Remote)
+	if err != nil {
+		return nil, fmt.Errorf("creating the http client of the remote sources: %w", err)
+	}
+
+	if c.S3.Enabled() {
+		s3Config := c.S3
+		s3Config.KidPathSeparator = c.KidPathSeparator
+		s3Config.MaxObjectSize = c.Files.MaxFileSize
+
+		sources = append(sources, keysource.NewS3(s3Config, client))
+	}
+
+	for _, u := range c.RemoteJWKS {
+		sources = append(sources, keysource.NewRemote(u, c.Remote, client))
+	}
+
+	for _, i := range c.OIDCIssuers {
+		alias, issuer := parseIssuer(i)
+
+		oidcConfig := keysource.OIDCConfig{
+			Remote:            c.Remote,
+			DiscoveryInterval: c.OIDCDiscoveryInterval,
+		}
+
+		if alias != "" {
+			oidcConfig.KidPrefix = alias + c.OIDCKidSeparator
+		}
+
+		sources = append(sources, keysource.NewOIDC(issuer, oidcConfig, client))
+	}
+
+	return sources, nil
+}
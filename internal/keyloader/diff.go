@@ -0,0 +1,166 @@
+package keyloader
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// KeysDiff describes how the published keys changed after a reload
+type KeysDiff struct {
+	// key ids that were not published before
+	Added []string `json:"added"`
+
+	// key ids that are no longer published
+	Removed []string `json:"removed"`
+
+	// key ids that are still published, but with different key material
+	Changed []string `json:"changed"`
+
+	// the version of the new keys, see keysVersion
+	Version string `json:"version"`
+
+	// the versions of the sources the new keys were loaded from, by source name, for example
+	// the commit of a git repository, the sources without a version are not included
+	SourceVersions map[string]string `json:"sourceVersions,omitempty"`
+
+	// the key ids of the keys that were loaded but not published because of the selection, see SelectionConfig
+	Excluded []string `json:"excluded,omitempty"`
+
+	// the load time of the new keys
+	LoadTime time.Time `json:"loadTime"`
+}
+
+// Empty returns true if the published keys did not change
+func (d KeysDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// diffKeys compares the key sets by key id, the key material is compared by the JWK thumbprint
+// old can be nil, in this case all the keys are reported as added
+func diffKeys(old, new jwk.Set) KeysDiff {
+	oldPrints := thumbprints(old)
+	newPrints := thumbprints(new)
+
+	diff := KeysDiff{}
+
+	for kid, p := range newPrints {
+		oldPrint, exists := oldPrints[kid]
+
+		switch {
+		case !exists:
+			diff.Added = append(diff.Added, kid)
+		case !bytes.Equal(oldPrint, p):
+			diff.Changed = append(diff.Changed, kid)
+		}
+	}
+
+	for kid := range oldPrints {
+		if _, exists := newPrints[kid]; !exists {
+			diff.Removed = append(diff.Removed, kid)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+
+	return diff
+}
+
+// keysVersion returns a version string for the key set, it changes when
+// a key id is added or removed or the material of a key changes
+func keysVersion(set jwk.Set) string {
+	prints := thumbprints(set)
+
+	kids := make([]string, 0, len(prints))
+	for kid := range prints {
+		kids = append(kids, kid)
+	}
+
+	sort.Strings(kids)
+
+	hash := sha256.New()
+	for _, kid := range kids {
+		hash.Write([]byte(kid))
+		hash.Write([]byte{0})
+		hash.Write(prints[kid])
+		hash.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// thumbprints returns the SHA-256 JWK thumbprints of the keys by key id
+func thumbprints(set jwk.Set) map[string][]byte {
+	prints := map[string][]byte{}
+
+	if set == nil {
+		return prints
+	}
+
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Get(i)
+
+		p, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			// can not happen for the supported key types, make sure a change is detected anyway
+			log.Error().Err(err).Str("keyId", key.KeyID()).Msg("failed to compute key thumbprint")
+			p = nil
+		}
+
+		prints[key.KeyID()] = p
+	}
+
+	return prints
+}
+
+// subscriberBufferSize is the number of diffs buffered for a subscriber before the diffs are dropped
+const subscriberBufferSize = 16
+
+// Subscribe returns a channel receiving the diff after every reload that changed the published keys
+// the returned function cancels the subscription and closes the channel,
+// a subscriber that does not keep up misses diffs, this is logged as a warning
+func (kl *Keyloader) Subscribe() (<-chan KeysDiff, func()) {
+	ch := make(chan KeysDiff, subscriberBufferSize)
+
+	kl.subMutex.Lock()
+	defer kl.subMutex.Unlock()
+
+	if kl.subscribers == nil {
+		kl.subscribers = map[chan KeysDiff]struct{}{}
+	}
+
+	kl.subscribers[ch] = struct{}{}
+
+	unsubscribe := func() {
+		kl.subMutex.Lock()
+		defer kl.subMutex.Unlock()
+
+		if _, ok := kl.subscribers[ch]; ok {
+			delete(kl.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return ch, unsubscribe
+}
+
+// notify sends the diff to all subscribers without blocking
+func (kl *Keyloader) notify(diff KeysDiff) {
+	kl.subMutex.Lock()
+	defer kl.subMutex.Unlock()
+
+	for ch := range kl.subscribers {
+		select {
+		case ch <- diff:
+		default:
+			log.Warn().Msg("keys diff subscriber is not keeping up, diff dropped")
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package keyloader
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"go-jwks-server/internal/keysource"
+	"reflect"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+func TestDiffKeys(t *testing.T) {
+	key1 := newTestKey(t, "key1")
+	key2 := newTestKey(t, "key2")
+	key3 := newTestKey(t, "key3")
+	key3Rotated := newTestKey(t, "key3")
+
+	old := jwk.NewSet()
+	old.Add(key1)
+	old.Add(key2)
+	old.Add(key3)
+
+	new := jwk.NewSet()
+	new.Add(key1)
+	new.Add(key3Rotated)
+	new.Add(newTestKey(t, "key4"))
+
+	got := diffKeys(old, new)
+	want := KeysDiff{
+		Added:   []string{"key4"},
+		Removed: []string{"key2"},
+		Changed: []string{"key3"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffKeys() = %#v, want %#v", got, want)
+	}
+
+	if got := diffKeys(nil, old); !reflect.DeepEqual(got.Added, []string{"key1", "key2", "key3"}) {
+		t.Errorf("diffKeys(nil, old).Added = %#v", got.Added)
+	}
+
+	if got := diffKeys(old, old); !got.Empty() {
+		t.Errorf("diffKeys(old, old) = %#v, want empty", got)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	kl := &Keyloader{}
+
+	ch, unsubscribe := kl.Subscribe()
+
+	kl.notify(KeysDiff{Added: []string{"key1"}})
+
+	diff := <-ch
+	if !reflect.DeepEqual(diff.Added, []string{"key1"}) {
+		t.Errorf("received diff = %#v", diff)
+	}
+
+	unsubscribe()
+	unsubscribe() // must be safe to call twice
+
+	if _, ok := <-ch; ok {
+		t.Error("channel not closed after unsubscribe")
+	}
+
+	kl.notify(KeysDiff{Added: []string{"key2"}}) // must not panic
+}
+
+func TestPublishProvenance(t *testing.T) {
+	repo := jwk.NewSet()
+	repo.Add(newTestKey(t, "key1"))
+	repo.Add(newTestKey(t, "key2"))
+
+	dir := jwk.NewSet()
+	dir.Add(newTestKey(t, "key2"))
+
+	kl := &Keyloader{
+		sources: []keysource.KeySource{keysource.NewDir("/keys", keysource.DirConfig{}), &staticSource{name: "git:/repo@main"}},
+		states: []sourceState{
+			{attempted: true, loaded: &sourceKeys{keys: dir, infos: map[string]KeyInfo{"key2": {Source: "dir:/keys", Name: "key2.pub"}}}},
+			{attempted: true, loaded: &sourceKeys{keys: repo, version: "c0ffee", infos: map[string]KeyInfo{
+				"key1": {Source: "git:/repo@main", Name: "key1.pub", Version: "c0ffee"},
+				"key2": {Source: "git:/repo@main", Name: "key2.pub", Version: "c0ffee"},
+			}}},
+		},
+	}
+
+	ch, unsubscribe := kl.Subscribe()
+	defer unsubscribe()
+
+	kl.publish()
+
+	diff := <-ch
+	if want := map[string]string{"git:/repo@main": "c0ffee"}; !reflect.DeepEqual(diff.SourceVersions, want) {
+		t.Errorf("source versions = %v, want %v", diff.SourceVersions, want)
+	}
+
+	if info, _ := kl.GetKeyInfo("key1"); info.Version != "c0ffee" || info.Name != "key1.pub" {
+		t.Errorf("key1 info = %+v", info)
+	}
+
+	// key2 is published from the directory listed first
+	if info, _ := kl.GetKeyInfo("key2"); info.Source != "dir:/keys" || info.Version != "" {
+		t.Errorf("key2 info = %+v", info)
+	}
+}
+
+func newTestKey(t *testing.T, kid string) jwk.Key {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("failed to generate key:", err)
+	}
+
+	key, err := jwk.New(&priv.PublicKey)
+	if err != nil {
+		t.Fatal("failed to create JWK:", err)
+	}
+
+	key.Set(jwk.KeyIDKey, kid)
+
+	return key
+}
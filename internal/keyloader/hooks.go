@@ -0,0 +1,74 @@
+package keyloader
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// KeyInfo describes where a key was loaded from
+type KeyInfo struct {
+	// the name of the key source
+	Source string
+
+	// the name of the key material within the source, for example the path of the key file relative to the key directory
+	Name string
+
+	// the modification time of the key material, zero if unknown
+	ModTime time.Time
+
+	// the version of the source the key was loaded from, for example the commit of a git repository, empty if the source has none
+	Version string
+
+	// the labels of the key material, empty if the source has none
+	Labels map[string]string
+
+	// the key id of the key this key is a copy of, empty if the key is not an alias, see keysource.Alias
+	AliasOf string
+}
+
+// Hook processes the keys on every reload, after parsing and before publishing
+// it returns the key to publish, which can be the same key modified, a replacement or nil to drop the key
+// an error fails the load of the source and is reported for the key material name
+type Hook interface {
+	Process(key jwk.Key, info KeyInfo) (jwk.Key, error)
+}
+
+// TransformFunc is a Hook that modifies the key, for example to add parameters or to rewrite the key id
+type TransformFunc func(key jwk.Key, info KeyInfo) (jwk.Key, error)
+
+func (f TransformFunc) Process(key jwk.Key, info KeyInfo) (jwk.Key, error) {
+	return f(key, info)
+}
+
+// FilterFunc is a Hook that decides if the key is published
+type FilterFunc func(key jwk.Key, info KeyInfo) (bool, error)
+
+func (f FilterFunc) Process(key jwk.Key, info KeyInfo) (jwk.Key, error) {
+	keep, err := f(key, info)
+	if err != nil || !keep {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// applyHooks runs the hooks in order, stopping when a hook drops the key
+// if the key is dropped, the index of the hook dropping it is returned
+func applyHooks(hooks []Hook, key jwk.Key, info KeyInfo) (jwk.Key, int, error) {
+	for i, h := range hooks {
+		var err error
+
+		key, err = h.Process(key, info)
+		if err != nil {
+			return nil, i, fmt.Errorf("hook %d: %w", i, err)
+		}
+
+		if key == nil {
+			return nil, i, nil
+		}
+	}
+
+	return key, -1, nil
+}
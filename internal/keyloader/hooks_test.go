@@ -0,0 +1,96 @@
+package keyloader
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"go-jwks-server/internal/keysource"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+func TestLoadKeysHooks(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, name := range []string{"key1.pub", "key2.pub", "key3.pub"} {
+		writeTestPEM(t, filepath.Join(dir, name))
+	}
+
+	hooks := []Hook{
+		TransformFunc(func(key jwk.Key, info KeyInfo) (jwk.Key, error) {
+			key.Set(jwk.AlgorithmKey, jwa.ES256)
+			key.Set(jwk.KeyIDKey, "team-a."+key.KeyID())
+			return key, nil
+		}),
+		FilterFunc(func(key jwk.Key, info KeyInfo) (bool, error) {
+			return info.Name != "key2.pub", nil
+		}),
+	}
+
+	source := keysource.NewDir(dir, keysource.DirConfig{KidPathSeparator: "/"})
+
+	loaded, err := loadKeys(context.Background(), source, hooks)
+	if err != nil {
+		t.Fatal("loadKeys() error:", err)
+	}
+
+	keys := loaded.keys
+
+	if keys.Len() != 2 {
+		t.Fatalf("loaded %d keys, want 2", keys.Len())
+	}
+
+	for _, kid := range []string{"team-a.key1", "team-a.key3"} {
+		key, ok := keys.LookupKeyID(kid)
+		if !ok {
+			t.Errorf("key %s not loaded", kid)
+			continue
+		}
+
+		if key.Algorithm() != jwa.ES256.String() {
+			t.Errorf("key %s alg = %s, want %s", kid, key.Algorithm(), jwa.ES256)
+		}
+	}
+
+	failing := FilterFunc(func(key jwk.Key, info KeyInfo) (bool, error) {
+		if info.Name == "key3.pub" {
+			return false, errors.New("rejected")
+		}
+
+		return true, nil
+	})
+
+	_, err = loadKeys(context.Background(), source, []Hook{failing})
+	if err == nil || !strings.Contains(err.Error(), "key3.pub") {
+		t.Errorf("loadKeys() error = %v, want an error for key3.pub", err)
+	}
+}
+
+func writeTestPEM(t *testing.T, path string) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("failed to generate key:", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal("failed to marshal key:", err)
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal("failed to write key:", err)
+	}
+}
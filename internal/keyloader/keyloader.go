@@ -3,39 +3,108 @@ package keyloader
 import (
 	"context"
 	"errors"
-	"go-jwks-server/internal/keyfiles"
+	"fmt"
+	"go-jwks-server/internal/keysource"
 	"sync"
 	"time"
 
 	"github.com/lestrrat-go/jwx/jwk"
+	"golang.org/x/sync/errgroup"
 )
 
 /*
-	this package watches a directory for changes and loads public keys from files in that directory
-	file names must be the key name and the file content must be the key value
+	this package loads public keys from key sources, watches them for changes and publishes the keys
 
+	the default source is a directory, file names must be the key name and the file content must be the key value
 	key Id is derived from the file name, the .pub extension is removed if present
 	to ignore a file, add a .ignore extension
+
+	in recursive mode the key Id is derived from the path relative to the directory,
+	the path elements are joined with the configured separator
+
+	the keys of all sources are merged into one set, on key Id conflicts
+	the source listed first takes precedence, the upstream JWKS URLs come after the local keys
 */
 
 type Keyloader struct {
 	config Config
 
-	// the keys loaded from the directory
+	// the keys loaded from the sources
 	keys              jwk.Set
 	keysLoadTimestamp time.Time
+	keysVersion       string
+
+	// where the published keys were loaded from, by key id, and the versions of the sources, by source name
+	keyInfos       map[string]KeyInfo
+	sourceVersions map[string]string
 
-	// the mutex to protect the keys and keysTimestamp
+	// the key ids of the keys excluded by the selection, see SelectionConfig
+	excluded []string
+
+	// the mutex to protect the keys, keysTimestamp, keysVersion, keyInfos, sourceVersions and excluded
 	m sync.RWMutex
+
+	// serializes the publishing of the keys, protects the keys and attempted fields of states
+	loadMutex sync.Mutex
+
+	// the key sources, in the order of precedence, and their state
+	sources []keysource.KeySource
+	states  []sourceState
+
+	// run on every key before publishing
+	hooks []Hook
+
+	// the channels receiving the diffs of the published keys, protected by subMutex
+	subscribers map[chan KeysDiff]struct{}
+	subMutex    sync.Mutex
+
+	// the next time a key enters or leaves its validity window, zero if none does, protected by loadMutex
+	nextCheck time.Time
+
+	// signaled when nextCheck changes
+	validityChanged chan struct{}
 }
 
-func NewKeyloader(config Config) (*Keyloader, error) {
+// sourceState holds the last good keys of a source
+type sourceState struct {
+	// nil until the source is loaded successfully
+	loaded *sourceKeys
+
+	// set after the first load attempt, successful or not
+	attempted bool
+
+	// serializes the loads of the source, so an older snapshot never replaces a newer one
+	fetchMutex *sync.Mutex
+}
+
+// NewKeyloader creates the keyloader for the configured sources followed by the extra sources,
+// the hooks are run in order on every key on every reload
+func NewKeyloader(config Config, extra []keysource.KeySource, hooks ...Hook) (*Keyloader, error) {
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
 
+	sources, err := config.sources()
+	if err != nil {
+		return nil, err
+	}
+
+	sources = append(sources, extra...)
+	if len(sources) == 0 {
+		return nil, errors.New("no key source configured, provide a key-dir, a key-file, a key-archive, a key-manifest, inline keys, a remote-jwks-url or an oidc-issuer")
+	}
+
 	kl := &Keyloader{
-		config: config,
+		config:  config,
+		sources: sources,
+		states:  make([]sourceState, len(sources)),
+		hooks:   hooks,
+
+		validityChanged: make(chan struct{}, 1),
+	}
+
+	for i := range kl.states {
+		kl.states[i].fetchMutex = &sync.Mutex{}
 	}
 
 	return kl, nil
@@ -48,6 +117,45 @@ func (kl *Keyloader) GetKeysLoadTime() time.Time {
 	return kl.keysLoadTimestamp
 }
 
+// GetKeysVersion returns the version of the published keys, empty if no keys are published yet
+func (kl *Keyloader) GetKeysVersion() string {
+	kl.m.RLock()
+	defer kl.m.RUnlock()
+
+	return kl.keysVersion
+}
+
+// GetKeyInfo returns where the published key with the key id was loaded from
+func (kl *Keyloader) GetKeyInfo(kid string) (KeyInfo, bool) {
+	kl.m.RLock()
+	defer kl.m.RUnlock()
+
+	info, ok := kl.keyInfos[kid]
+	return info, ok
+}
+
+// GetExcludedKeys returns the sorted key ids of the keys excluded from the published keys by the selection, see SelectionConfig
+func (kl *Keyloader) GetExcludedKeys() []string {
+	kl.m.RLock()
+	defer kl.m.RUnlock()
+
+	return append([]string(nil), kl.excluded...)
+}
+
+// GetSourceVersions returns the versions of the sources the published keys were loaded from, by source name,
+// for example the commit of a git repository, the sources without a version are not included
+func (kl *Keyloader) GetSourceVersions() map[string]string {
+	kl.m.RLock()
+	defer kl.m.RUnlock()
+
+	versions := make(map[string]string, len(kl.sourceVersions))
+	for name, v := range kl.sourceVersions {
+		versions[name] = v
+	}
+
+	return versions
+}
+
 // GetKeys returns a copy of the keys
 func (kl *Keyloader) GetKeys() (jwk.Set, time.Time, error) {
 	kl.m.RLock()
@@ -60,75 +168,286 @@ func (kl *Keyloader) GetKeys() (jwk.Set, time.Time, error) {
 	return kl.keys, kl.keysLoadTimestamp, nil
 }
 
-// LoadKeysWatch starts watching the directory for changes and loads the keys
+// LoadKeysWatch watches every source for changes and reloads its keys, until the context is done
+// the keys are not loaded initially, call LoadKeys for that
 // it honors the FailOnError config option
 func (kl *Keyloader) LoadKeysWatch(ctx context.Context) error {
-	watcher := keyfiles.NewWatcher()
+	eg, ctx := errgroup.WithContext(ctx)
 
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+	for i := range kl.sources {
+		i := i
+		eg.Go(func() error {
+			return kl.watchSource(ctx, i)
+		})
+	}
 
-	wg := sync.WaitGroup{}
+	eg.Go(func() error {
+		kl.watchValidity(ctx)
+		return nil
+	})
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		err := watcher.Watch(ctx, kl.config.Dir, kl.config.WatchInterval)
-		log.Debug().Err(err).Msg("watcher goroutine exited")
+	return eg.Wait()
+}
 
-		cancel()
-	}()
+// watchValidity publishes the keys again when a key enters or leaves its validity window
+func (kl *Keyloader) watchValidity(ctx context.Context) {
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
 
-	log.Info().Str("dir", kl.config.Dir).Dur("interval", kl.config.WatchInterval).Msg("started watching directory for changes")
-	defer log.Info().Msg("stopped watching directory for changes")
+	for {
+		select {
+		case <-ctx.Done():
+			return
 
-	var retErr error
+		case <-kl.validityChanged:
 
-	// watcher will close the channel when done
-	for event := range watcher.Events {
-		if event.Error != nil {
-			if kl.config.FailOnError {
-				retErr = event.Error
-				cancel()
-				break
+		case <-timer.C:
+			log.Debug().Msg("key validity window changed, publishing")
+
+			kl.loadMutex.Lock()
+			kl.publish()
+			kl.loadMutex.Unlock()
+		}
+
+		kl.loadMutex.Lock()
+		next := kl.nextCheck
+		kl.loadMutex.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
 			}
+		}
 
-			log.Error().Err(event.Error).Msg("watcher event error")
-			continue
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// watchSource watches the source with index i and reloads its keys on changes
+func (kl *Keyloader) watchSource(ctx context.Context, i int) error {
+	source := kl.sources[i]
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var loadErr error
+	var loadErrMutex sync.Mutex
+
+	err := source.Watch(ctx, func() {
+		loadErrMutex.Lock()
+		defer loadErrMutex.Unlock()
+
+		if loadErr != nil {
+			return
 		}
 
-		if err := kl.LoadKeys(); err != nil {
-			retErr = err
+		if err := kl.loadSourceAndPublish(ctx, i); err != nil {
+			loadErr = err
 			cancel()
-			break
 		}
+	})
+
+	loadErrMutex.Lock()
+	defer loadErrMutex.Unlock()
+
+	if loadErr != nil {
+		return loadErr
 	}
 
-	log.Info().Str("dir", kl.config.Dir).Msg("stopping watching directory for changes ...")
+	if err != nil {
+		if kl.config.FailOnError {
+			return fmt.Errorf("source %s: watch: %w", source.Name(), err)
+		}
 
-	wg.Wait()
+		log.Error().Err(err).Str("source", source.Name()).Msg("watching source failed, the source is no longer reloaded")
+	}
 
-	return retErr
+	return nil
 }
 
-// LoadKeysOnce loads the keys once
-// it honors the FailOnError config option
+// LoadKeys loads the keys of all sources once
+// it honors the FailOnError config option, it is safe to call it concurrently with LoadKeysWatch
 func (kl *Keyloader) LoadKeys() error {
-	keys, err := loadKeys(kl.config.Dir)
+	ctx := context.Background()
+
+	for i := range kl.sources {
+		if err := kl.loadSource(ctx, i); err != nil {
+			return err
+		}
+	}
+
+	kl.loadMutex.Lock()
+	defer kl.loadMutex.Unlock()
+
+	kl.publish()
+
+	return nil
+}
+
+// loadSourceAndPublish loads the keys of the source with index i and publishes the merged keys
+func (kl *Keyloader) loadSourceAndPublish(ctx context.Context, i int) error {
+	if err := kl.loadSource(ctx, i); err != nil {
+		return err
+	}
+
+	kl.loadMutex.Lock()
+	defer kl.loadMutex.Unlock()
+
+	kl.publish()
+
+	return nil
+}
+
+// loadSource loads the keys of the source with index i
+// on error the last good keys of the source are kept, unless FailOnError is set
+func (kl *Keyloader) loadSource(ctx context.Context, i int) error {
+	source := kl.sources[i]
+
+	kl.states[i].fetchMutex.Lock()
+	defer kl.states[i].fetchMutex.Unlock()
+
+	loaded, err := loadKeys(ctx, source, kl.hooks)
+
+	kl.loadMutex.Lock()
+	defer kl.loadMutex.Unlock()
+
+	kl.states[i].attempted = true
+
 	if err != nil {
 		if kl.config.FailOnError {
-			return err
+			return fmt.Errorf("source %s: %w", source.Name(), err)
 		}
 
-		log.Error().Err(err).Msg("failed to load keys")
+		log.Error().Err(err).Str("source", source.Name()).Msg("failed to load keys")
 		return nil // leave the old keys
 	}
 
-	kl.m.Lock()
-	defer kl.m.Unlock()
+	kl.states[i].loaded = loaded
+
+	return nil
+}
+
+// publish merges the keys of all sources and makes them available to GetKeys,
+// nothing is published until every source had a load attempt and one of them was loaded,
+// the caller must hold loadMutex
+func (kl *Keyloader) publish() {
+	sets := make([]jwk.Set, len(kl.states))
+	names := make([]string, len(kl.states))
 
+	now := time.Now()
+
+	var nextCheck time.Time
+
+	sourceVersions := map[string]string{}
+
+	anyLoaded := false
+
+	for i, s := range kl.states {
+		if !s.attempted {
+			return
+		}
+
+		names[i] = kl.sources[i].Name()
+
+		if s.loaded == nil {
+			log.Warn().Str("source", names[i]).Msg("no keys loaded from source")
+			continue
+		}
+
+		anyLoaded = true
+
+		if s.loaded.version != "" {
+			sourceVersions[names[i]] = s.loaded.version
+		}
+
+		var next time.Time
+
+		sets[i], next = filterValid(s.loaded.keys, s.loaded.validities, now)
+
+		if !next.IsZero() && (nextCheck.IsZero() || next.Before(nextCheck)) {
+			nextCheck = next
+		}
+	}
+
+	// an empty set would be served as valid, GetKeys reports the keys as not loaded instead
+	if !anyLoaded {
+		log.Error().Msg("no source was loaded, nothing published")
+		return
+	}
+
+	if !nextCheck.Equal(kl.nextCheck) {
+		kl.nextCheck = nextCheck
+
+		select {
+		case kl.validityChanged <- struct{}{}:
+		default:
+		}
+	}
+
+	keys, origin := mergeKeys(sets, names)
+
+	keyInfos := make(map[string]KeyInfo, len(origin))
+	windows := map[string]validity{}
+
+	for kid, i := range origin {
+		keyInfos[kid] = kl.states[i].loaded.infos[kid]
+
+		if window, ok := kl.states[i].loaded.validities[kid]; ok {
+			windows[kid] = window
+		}
+	}
+
+	var excluded []string
+
+	if kl.config.Selection.Enabled() {
+		keys, excluded = selectKeys(keys, keyInfos, windows, kl.config.Selection)
+
+		for _, kid := range excluded {
+			delete(keyInfos, kid)
+		}
+	}
+
+	loadTime := time.Now()
+	version := keysVersion(keys)
+
+	kl.m.Lock()
+	diff := diffKeys(kl.keys, keys)
 	kl.keys = keys
-	kl.keysLoadTimestamp = time.Now()
+	kl.keysLoadTimestamp = loadTime
+	kl.keysVersion = version
+	kl.keyInfos = keyInfos
+	kl.sourceVersions = sourceVersions
+	kl.excluded = excluded
+	kl.m.Unlock()
+
+	diff.LoadTime = loadTime
+	diff.Version = version
+	diff.SourceVersions = sourceVersions
+	diff.Excluded = excluded
+
+	if diff.Empty() {
+		log.Debug().Msg("published keys did not change")
+		return
+	}
 
-	return nil
+	event := log.Info().Strs("added", diff.Added).Strs("removed", diff.Removed).Strs("changed", diff.Changed).
+		Int("total", keys.Len()).Str("version", version)
+
+	if len(sourceVersions) > 0 {
+		event = event.Interface("sourceVersions", sourceVersions)
+	}
+
+	if len(excluded) > 0 {
+		event = event.Strs("excluded", excluded)
+	}
+
+	event.Msg("published keys changed")
+
+	kl.notify(diff)
 }
@@ -0,0 +1,128 @@
+package keyloader
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// publishedKids returns the sorted key ids of the published keys, nil if nothing was published
+func publishedKids(t *testing.T, kl *Keyloader) []string {
+	t.Helper()
+
+	keys, _, err := kl.GetKeys()
+	if err != nil {
+		return nil
+	}
+
+	kids := []string{}
+	for i := 0; i < keys.Len(); i++ {
+		key, _ := keys.Get(i)
+		kids = append(kids, key.KeyID())
+	}
+
+	sort.Strings(kids)
+
+	return kids
+}
+
+func TestMultipleDirs(t *testing.T) {
+	dir1 := t.TempDir()
+	dir2 := t.TempDir()
+
+	writeTestPEM(t, filepath.Join(dir1, "key1.pub"))
+	writeTestPEM(t, filepath.Join(dir1, "shared.pub"))
+	writeTestPEM(t, filepath.Join(dir2, "key2.pub"))
+	writeTestPEM(t, filepath.Join(dir2, "shared.pub"))
+
+	config := NewConfig()
+	config.Dirs = []string{dir1, dir2}
+
+	kl, err := NewKeyloader(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is published until every dir had a load attempt
+	if err := kl.loadSourceAndPublish(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if kids := publishedKids(t, kl); kids != nil {
+		t.Errorf("published %v before the second dir was loaded", kids)
+	}
+
+	if err := kl.loadSourceAndPublish(context.Background(), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"key1", "key2", "shared"}; !reflect.DeepEqual(publishedKids(t, kl), want) {
+		t.Errorf("published = %v, want %v", publishedKids(t, kl), want)
+	}
+
+	// the dir listed first wins the key id conflict
+	if info, _ := kl.GetKeyInfo("shared"); info.Source != "dir:"+dir1 {
+		t.Errorf("shared key loaded from %s, want the first dir", info.Source)
+	}
+
+	// a failing dir keeps its last good keys while the other one is reloaded
+	if err := os.WriteFile(filepath.Join(dir2, "broken.pub"), []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestPEM(t, filepath.Join(dir1, "key3.pub"))
+
+	if err := kl.LoadKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"key1", "key2", "key3", "shared"}; !reflect.DeepEqual(publishedKids(t, kl), want) {
+		t.Errorf("published = %v, want %v", publishedKids(t, kl), want)
+	}
+
+	if info, _ := kl.GetKeyInfo("key2"); info.Source != "dir:"+dir2 {
+		t.Errorf("key2 info = %+v, want the last good keys of the second dir", info)
+	}
+}
+
+func TestNothingLoaded(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "broken.pub"), []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := NewConfig()
+	config.Dirs = []string{dir}
+
+	kl, err := NewKeyloader(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := kl.LoadKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty set is not published when every source failed
+	if _, _, err := kl.GetKeys(); err == nil {
+		t.Error("keys published while no source was loaded")
+	}
+
+	if err := os.Remove(filepath.Join(dir, "broken.pub")); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestPEM(t, filepath.Join(dir, "key1.pub"))
+
+	if err := kl.LoadKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"key1"}; !reflect.DeepEqual(publishedKids(t, kl), want) {
+		t.Errorf("published = %v, want %v", publishedKids(t, kl), want)
+	}
+}
@@ -1,24 +1,36 @@
 package keyloader
 
 import (
+	"bytes"
+	"context"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
-	"go-jwks-server/internal/keyfiles"
-	"os"
-	"path/filepath"
+	"go-jwks-server/internal/keysource"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/lestrrat-go/jwx/jwk"
 )
 
+// LoadPublicKey parses the first PEM block of key, the Kid, Alg and Use headers of the block are applied to the key
 func LoadPublicKey(key []byte) (jwk.Key, error) {
 	keyPem, _ := pem.Decode(key)
 	if keyPem == nil {
 		return nil, errors.New("failed to decode PEM file")
 	}
 
+	parsed, err := parsePEMBlock(keyPem)
+	if err != nil {
+		return nil, err
+	}
+
+	return parsed.key, nil
+}
+
+func publicKeyFromPEM(keyPem *pem.Block) (jwk.Key, error) {
 	if keyPem.Type != "PUBLIC KEY" {
 		return nil, fmt.Errorf("public key wrong type: %s", keyPem.Type)
 	}
@@ -36,8 +48,11 @@ func LoadPublicKey(key []byte) (jwk.Key, error) {
 	return jwkPubKey, nil
 }
 
+// maxPublicKeyFileSize bounds the read of LoadPublicKeyFromFile, a PEM public key is a few KiB
+const maxPublicKeyFileSize = 1 << 20
+
 func LoadPublicKeyFromFile(file string) (jwk.Key, error) {
-	pubBuf, err := os.ReadFile(file)
+	pubBuf, _, err := keysource.ReadFile(file, maxPublicKeyFileSize)
 	if err != nil {
 		return nil, fmt.Errorf("reading public key file: %w", err)
 	}
@@ -45,44 +60,397 @@ func LoadPublicKeyFromFile(file string) (jwk.Key, error) {
 	return LoadPublicKey(pubBuf)
 }
 
-func loadKeys(dir string) (jwk.Set, error) {
-	fileMetadata, skipped, err := keyfiles.GetFileMetadata(dir)
+// LoadReport describes the outcome of loading the keys of a source, the maps are keyed by the names in the source
+type LoadReport struct {
+	Source string
+
+	// the key ids of the published keys
+	Loaded map[string][]string
+
+	// the reason every skipped entry was not considered
+	Skipped map[string]string
+
+	// the hook that dropped the key
+	Dropped map[string]string
+
+	// the error loading the key, any error fails the load of the source
+	Errors map[string]string
+
+	// the problems that did not prevent loading the key, like unknown PEM headers
+	Warnings map[string]string
+}
+
+func newLoadReport(source string) *LoadReport {
+	return &LoadReport{
+		Source:   source,
+		Loaded:   map[string][]string{},
+		Skipped:  map[string]string{},
+		Dropped:  map[string]string{},
+		Errors:   map[string]string{},
+		Warnings: map[string]string{},
+	}
+}
+
+// log writes the report as one log event, at info level if anything was not loaded
+func (r *LoadReport) log() {
+	event := log.Debug()
+	if len(r.Skipped) > 0 || len(r.Dropped) > 0 || len(r.Errors) > 0 || len(r.Warnings) > 0 {
+		event = log.Info()
+	}
+
+	if len(r.Errors) > 0 {
+		event = log.Error()
+	}
+
+	event.Str("source", r.Source).Interface("loaded", r.Loaded).Interface("skipped", r.Skipped).
+		Interface("dropped", r.Dropped).Interface("errors", r.Errors).Interface("warnings", r.Warnings).Msg("loaded keys")
+}
+
+// sourceKeys are the keys loaded from a source
+type sourceKeys struct {
+	keys jwk.Set
+
+	// the validity windows of the keys, by key id, only for the keys that have one
+	validities map[string]validity
+
+	// where every key was loaded from, by key id
+	infos map[string]KeyInfo
+
+	// the version of the snapshot, see keysource.Snapshot
+	version string
+}
+
+// add adds the key with its info and validity window, it returns false if a key with the same key id is already loaded
+func (s *sourceKeys) add(key jwk.Key, info KeyInfo, window validity) bool {
+	if _, exists := s.keys.LookupKeyID(key.KeyID()); exists {
+		return false
+	}
+
+	s.keys.Add(key)
+	s.infos[key.KeyID()] = info
+
+	if !window.unbounded() {
+		s.validities[key.KeyID()] = window
+	}
+
+	return true
+}
+
+// loadKeys fetches the key material of the source, parses it and runs the hooks
+func loadKeys(ctx context.Context, source keysource.KeySource, hooks []Hook) (*sourceKeys, error) {
+	snapshot, err := source.Fetch(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("getting file metadata: %w", err)
+		return nil, fmt.Errorf("fetching keys: %w", err)
+	}
+
+	report := newLoadReport(source.Name())
+	defer report.log()
+
+	for name, reason := range snapshot.Skipped {
+		report.Skipped[name] = reason
+	}
+
+	var firstErr error
+
+	fail := func(name string, err error) {
+		report.Errors[name] = err.Error()
+		if firstErr == nil {
+			firstErr = fmt.Errorf("loading key from %s: %w", name, err)
+		}
+	}
+
+	loaded := &sourceKeys{
+		keys:       jwk.NewSet(),
+		validities: map[string]validity{},
+		infos:      map[string]KeyInfo{},
+		version:    snapshot.Version,
+	}
+
+	now := time.Now()
+
+	for _, kd := range snapshot.Keys {
+		keys, warnings, err := parseKeyData(kd)
+		if err != nil {
+			fail(kd.Name, err)
+			continue
+		}
+
+		if len(kd.Aliases) > 0 && len(keys) > 1 {
+			fail(kd.Name, fmt.Errorf("aliases need key material with a single key, found %d keys", len(keys)))
+			continue
+		}
+
+		info := KeyInfo{Source: source.Name(), Name: kd.Name, ModTime: kd.ModTime, Version: snapshot.Version, Labels: kd.Labels}
+
+		var unknownHeaders []string
+
+		for _, parsed := range keys {
+			unknownHeaders = append(unknownHeaders, parsed.unknownHeaders...)
+
+			window := validity{notBefore: kd.NotBefore, expires: kd.Expires}.restrict(parsed.window)
+
+			// the keys are kept, they are published when they enter their window
+			if reason := window.outside(now); reason != "" {
+				report.Skipped[kd.Name] = reason
+			}
+
+			key, hook, err := applyHooks(hooks, parsed.key, info)
+			if err != nil {
+				fail(kd.Name, err)
+				break
+			}
+
+			if key == nil {
+				report.Dropped[kd.Name] = fmt.Sprintf("dropped by hook %d", hook)
+				continue
+			}
+
+			if !loaded.add(key, info, window) {
+				log.Warn().Str("source", source.Name()).Str("name", kd.Name).Str("keyId", key.KeyID()).Msg("key already loaded")
+				continue
+			}
+
+			report.Loaded[kd.Name] = append(report.Loaded[kd.Name], key.KeyID())
+
+			// the aliases are copies of the key after the hooks, each restricted to its own expiry
+			for _, alias := range kd.Aliases {
+				aliasKey, err := key.Clone()
+				if err != nil {
+					fail(kd.Name, fmt.Errorf("copying the key for alias %s: %w", alias.Kid, err))
+					break
+				}
+
+				aliasKey.Set(jwk.KeyIDKey, kd.KidPrefix+alias.Kid)
+
+				aliasInfo := info
+				aliasInfo.AliasOf = key.KeyID()
+
+				aliasWindow := window.restrict(validity{expires: alias.Expires})
+
+				if reason := aliasWindow.outside(now); reason != "" {
+					report.Skipped[kd.Name+" alias "+aliasKey.KeyID()] = reason
+				}
+
+				if !loaded.add(aliasKey, aliasInfo, aliasWindow) {
+					log.Warn().Str("source", source.Name()).Str("name", kd.Name).Str("keyId", aliasKey.KeyID()).Msg("key already loaded")
+					continue
+				}
+
+				report.Loaded[kd.Name] = append(report.Loaded[kd.Name], aliasKey.KeyID())
+			}
+		}
+
+		if len(unknownHeaders) > 0 {
+			warnings = append(warnings, "unknown PEM headers: "+strings.Join(unknownHeaders, ", "))
+		}
+
+		if len(warnings) > 0 {
+			report.Warnings[kd.Name] = strings.Join(warnings, "; ")
+		}
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
 	}
 
-	keySet := jwk.NewSet()
+	return loaded, nil
+}
 
-	loaded := map[string]string{}
+// parsedKey is a key parsed from the key material, with the metadata of the material that is not part of the key
+type parsedKey struct {
+	key jwk.Key
 
-	for _, f := range fileMetadata {
-		fullPath := filepath.Join(dir, f.Name)
+	// the validity window from the Nbf and Exp PEM headers
+	window validity
 
-		key, err := LoadPublicKeyFromFile(fullPath)
+	// the names of the PEM headers that are not recognised
+	unknownHeaders []string
+}
+
+// parseKeyData parses PEM encoded public keys or JWK/JWKS JSON, only the public part of the keys is kept
+// the keys without a key id get the key id of the key data, see KeyData.Kid and KeyData.KidStrict,
+// then KeyData.KidPrefix is applied
+// KeyData.Alg and KeyData.Use replace the ones in the material, including the ones of the PEM headers
+// the PEM blocks that are not public keys (certificates, private keys) and the trailing non PEM data are skipped,
+// they are returned as warnings
+func parseKeyData(kd keysource.KeyData) ([]parsedKey, []string, error) {
+	data := bytes.TrimSpace(kd.Data)
+
+	var keys []parsedKey
+	var warnings []string
+
+	if bytes.HasPrefix(data, []byte("{")) {
+		set, err := jwk.Parse(data)
 		if err != nil {
-			return nil, fmt.Errorf("loading key from %s: %w", fullPath, err)
+			return nil, nil, fmt.Errorf("parsing JWK: %w", err)
 		}
 
-		keyId := f.Name
-		if strings.HasSuffix(strings.ToLower(keyId), ".pub") {
-			keyId = keyId[:len(keyId)-4]
+		set, err = jwk.PublicSetOf(set)
+		if err != nil {
+			return nil, nil, fmt.Errorf("getting public keys: %w", err)
+		}
+
+		for i := 0; i < set.Len(); i++ {
+			key, _ := set.Get(i)
+			keys = append(keys, parsedKey{key: key})
 		}
+	} else {
+		for len(data) > 0 {
+			keyPem, rest := pem.Decode(data)
+			if keyPem == nil {
+				if len(keys) == 0 && len(warnings) == 0 {
+					return nil, nil, errors.New("failed to decode PEM file")
+				}
+
+				warnings = append(warnings, fmt.Sprintf("ignored %d bytes of trailing data", len(data)))
+				break
+			}
 
-		key.Set(jwk.KeyIDKey, keyId)
-		key.Set(jwk.KeyUsageKey, jwk.ForSignature)
+			data = bytes.TrimSpace(rest)
 
-		added := keySet.Add(key)
+			if keyPem.Type != "PUBLIC KEY" {
+				warnings = append(warnings, "skipped PEM block "+keyPem.Type)
+				continue
+			}
 
-		if !added {
-			log.Warn().Str("filename", f.Name).Str("keyId", keyId).Msg("key already loaded")
+			parsed, err := parsePEMBlock(keyPem)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			keys = append(keys, parsed)
 		}
+	}
+
+	if len(keys) == 0 {
+		return nil, nil, errors.New("no keys found")
+	}
 
-		loaded[f.Name] = keyId
+	withoutKid := 0
+	for _, parsed := range keys {
+		if parsed.key.KeyID() == "" {
+			withoutKid++
+		}
 	}
 
-	if len(skipped) > 0 {
-		log.Info().Interface("skipped", skipped).Interface("loaded", loaded).Msg("loaded keys")
+	n := 0
+	for _, parsed := range keys {
+		key := parsed.key
+
+		if key.KeyID() == "" {
+			if kd.Kid == "" {
+				return nil, nil, errors.New("key has no key id")
+			}
+
+			n++
+
+			kid := kd.Kid
+			if withoutKid > 1 {
+				kid = fmt.Sprintf("%s-%d", kd.Kid, n)
+			}
+
+			key.Set(jwk.KeyIDKey, kid)
+		} else if kd.KidStrict && key.KeyID() != kd.Kid {
+			return nil, nil, fmt.Errorf("the key id %s of the material does not match the key id %s", key.KeyID(), kd.Kid)
+		}
+
+		if kd.KidPrefix != "" {
+			key.Set(jwk.KeyIDKey, kd.KidPrefix+key.KeyID())
+		}
+
+		if kd.Alg != "" {
+			key.Set(jwk.AlgorithmKey, kd.Alg)
+		}
+
+		if kd.Use != "" {
+			key.Set(jwk.KeyUsageKey, kd.Use)
+		}
+
+		if key.KeyUsage() == "" {
+			key.Set(jwk.KeyUsageKey, jwk.ForSignature)
+		}
+	}
+
+	return keys, warnings, nil
+}
+
+// parsePEMBlock parses a PEM block, which must be a public key
+// the Kid, Alg and Use headers of the block are set on the key and the Nbf and Exp headers make its validity window,
+// the header names are case insensitive
+func parsePEMBlock(keyPem *pem.Block) (parsedKey, error) {
+	key, err := publicKeyFromPEM(keyPem)
+	if err != nil {
+		return parsedKey{}, err
+	}
+
+	parsed := parsedKey{key: key}
+
+	// sorted, so the errors and the reports do not depend on the map order
+	names := make([]string, 0, len(keyPem.Headers))
+	for name := range keyPem.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := keyPem.Headers[name]
+
+		switch strings.ToLower(name) {
+		case "kid":
+			err = key.Set(jwk.KeyIDKey, value)
+
+		case "alg":
+			if err = keysource.ValidateAlgUse(value, ""); err == nil {
+				err = key.Set(jwk.AlgorithmKey, value)
+			}
+
+		case "use":
+			if err = keysource.ValidateAlgUse("", value); err == nil {
+				err = key.Set(jwk.KeyUsageKey, value)
+			}
+
+		case "nbf":
+			parsed.window.notBefore, err = keysource.ParseTimestamp(value)
+
+		case "exp":
+			parsed.window.expires, err = keysource.ParseTimestamp(value)
+
+		default:
+			parsed.unknownHeaders = append(parsed.unknownHeaders, name)
+		}
+
+		if err != nil {
+			return parsedKey{}, fmt.Errorf("PEM header %s: %w", name, err)
+		}
+	}
+
+	return parsed, nil
+}
+
+// mergeKeys merges the key sets into one, nil sets are skipped, and returns the index of the set every key is from
+// on key id conflicts the key from the set listed first is kept, names are used for logging
+func mergeKeys(sets []jwk.Set, names []string) (jwk.Set, map[string]int) {
+	merged := jwk.NewSet()
+	origin := map[string]int{}
+
+	for i, set := range sets {
+		if set == nil {
+			continue
+		}
+
+		for j := 0; j < set.Len(); j++ {
+			key, _ := set.Get(j)
+
+			if _, exists := merged.LookupKeyID(key.KeyID()); exists {
+				log.Warn().Str("keyId", key.KeyID()).Str("source", names[i]).Str("keptFrom", names[origin[key.KeyID()]]).
+					Msg("key id conflict, key ignored")
+				continue
+			}
+
+			merged.Add(key)
+			origin[key.KeyID()] = i
+		}
 	}
 
-	return keySet, nil
+	return merged, origin
 }
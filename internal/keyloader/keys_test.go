@@ -0,0 +1,340 @@
+package keyloader
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/json"
+	"encoding/pem"
+	"go-jwks-server/internal/keysource"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+func TestParseKeyData(t *testing.T) {
+	dir := t.TempDir()
+
+	pem1 := readTestPEM(t, dir, "key1")
+	pem2 := readTestPEM(t, dir, "key2")
+
+	withKid := jwk.NewSet()
+	withKid.Add(newTestKey(t, "jwk1"))
+	withKid.Add(newTestKey(t, "jwk2"))
+
+	jwks, err := json.Marshal(withKid)
+	if err != nil {
+		t.Fatal("failed to marshal JWKS:", err)
+	}
+
+	single, err := json.Marshal(newTestKey(t, ""))
+	if err != nil {
+		t.Fatal("failed to marshal JWK:", err)
+	}
+
+	tests := []struct {
+		name    string
+		kd      keysource.KeyData
+		want    []string
+		wantErr bool
+	}{
+		{"single PEM", keysource.KeyData{Kid: "file1", Data: pem1}, []string{"file1"}, false},
+		{"PEM bundle", keysource.KeyData{Kid: "bundle", Data: append(append([]byte{}, pem1...), pem2...)}, []string{"bundle-1", "bundle-2"}, false},
+		{"JWKS keeps key ids", keysource.KeyData{Kid: "file1", Data: jwks}, []string{"jwk1", "jwk2"}, false},
+		{"JWK without key id", keysource.KeyData{Kid: "file1", Data: single}, []string{"file1"}, false},
+		{"JWKS with prefix", keysource.KeyData{Data: jwks, KidPrefix: "partner:"}, []string{"partner:jwk1", "partner:jwk2"}, false},
+		{"PEM bundle with prefix", keysource.KeyData{Kid: "bundle", KidPrefix: "p/", Data: append(append([]byte{}, pem1...), pem2...)}, []string{"p/bundle-1", "p/bundle-2"}, false},
+		{"alg and use from the key data", keysource.KeyData{Kid: "file1", Data: pem1, Alg: "ES256", Use: "enc"}, []string{"file1"}, false},
+		{"strict key id without key id in the material", keysource.KeyData{Kid: "file1", KidStrict: true, Data: single}, []string{"file1"}, false},
+		{"strict key id conflicting with the material", keysource.KeyData{Kid: "jwk1", KidStrict: true, Data: jwks}, nil, true},
+		{"no key id at all", keysource.KeyData{Data: pem1}, nil, true},
+		{"garbage", keysource.KeyData{Kid: "file1", Data: []byte("garbage")}, nil, true},
+		{"empty", keysource.KeyData{Kid: "file1"}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, _, err := parseKeyData(tt.kd)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseKeyData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			var kids []string
+			for _, parsed := range keys {
+				key := parsed.key
+				kids = append(kids, key.KeyID())
+
+				wantUse := string(jwk.ForSignature)
+				if tt.kd.Use != "" {
+					wantUse = tt.kd.Use
+				}
+
+				if key.KeyUsage() != wantUse {
+					t.Errorf("key %s use = %s, want %s", key.KeyID(), key.KeyUsage(), wantUse)
+				}
+
+				if alg := key.Algorithm(); alg != tt.kd.Alg {
+					t.Errorf("key %s alg = %s, want %s", key.KeyID(), alg, tt.kd.Alg)
+				}
+			}
+
+			if !reflect.DeepEqual(kids, tt.want) {
+				t.Errorf("parseKeyData() kids = %v, want %v", kids, tt.want)
+			}
+		})
+	}
+}
+
+// TestParseKeyDataExtraBlocks parses a key file as they were loaded before the PEM bundles,
+// only its public key is kept and the rest is reported
+func TestParseKeyDataExtraBlocks(t *testing.T) {
+	dir := t.TempDir()
+
+	var data []byte
+	data = append(data, "# signing key of the payments service\n"...)
+	data = append(data, readTestPEM(t, dir, "key")...)
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("leaf")})...)
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("intermediate")})...)
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("private")})...)
+	data = append(data, "rotated by ops on 2024-06-05\n"...)
+
+	keys, warnings, err := parseKeyData(keysource.KeyData{Kid: "key", Data: data})
+	if err != nil {
+		t.Fatal("parseKeyData() error:", err)
+	}
+
+	if len(keys) != 1 || keys[0].key.KeyID() != "key" {
+		t.Errorf("parseKeyData() = %d keys, want the public key", len(keys))
+	}
+
+	wantWarnings := []string{
+		"skipped PEM block CERTIFICATE",
+		"skipped PEM block CERTIFICATE",
+		"skipped PEM block PRIVATE KEY",
+		"ignored 28 bytes of trailing data",
+	}
+	if !reflect.DeepEqual(warnings, wantWarnings) {
+		t.Errorf("warnings = %q, want %q", warnings, wantWarnings)
+	}
+
+	// without a public key there is nothing to load
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("leaf")})
+	if _, _, err := parseKeyData(keysource.KeyData{Kid: "key", Data: certificate}); err == nil {
+		t.Errorf("parseKeyData() of a certificate must fail")
+	}
+}
+
+func TestLoadPublicKeyFromFile(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "key.pub")
+	writeTestPEM(t, path)
+
+	if _, err := LoadPublicKeyFromFile(path); err != nil {
+		t.Fatal("load:", err)
+	}
+
+	// the read is bounded
+	large := filepath.Join(dir, "large.pub")
+	if err := os.WriteFile(large, bytes.Repeat([]byte("x"), maxPublicKeyFileSize+1), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadPublicKeyFromFile(large); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Errorf("load of a large file error = %v, want a size error", err)
+	}
+}
+
+func TestParsePEMHeaders(t *testing.T) {
+	dir := t.TempDir()
+
+	withHeaders := func(headers map[string]string) []byte {
+		block, _ := pem.Decode(readTestPEM(t, dir, "key"))
+		block.Headers = headers
+
+		return pem.EncodeToMemory(block)
+	}
+
+	signer := withHeaders(map[string]string{
+		"Kid":     "signer-2024",
+		"Alg":     "PS256",
+		"Use":     "sig",
+		"Nbf":     "2024-01-01T00:00:00Z",
+		"exp":     "1735689600",
+		"Comment": "rotated by ops",
+	})
+	plain := readTestPEM(t, dir, "plain")
+
+	keys, _, err := parseKeyData(keysource.KeyData{Kid: "bundle", Data: append(append([]byte{}, signer...), plain...)})
+	if err != nil {
+		t.Fatal("parseKeyData() error:", err)
+	}
+
+	// the key with a Kid header does not count for the numbering of the others
+	if len(keys) != 2 || keys[0].key.KeyID() != "signer-2024" || keys[1].key.KeyID() != "bundle" {
+		t.Fatalf("parseKeyData() = %d keys", len(keys))
+	}
+
+	first := keys[0]
+	if first.key.Algorithm() != "PS256" || first.key.KeyUsage() != "sig" {
+		t.Errorf("alg = %s, use = %s, want the ones of the headers", first.key.Algorithm(), first.key.KeyUsage())
+	}
+
+	want := validity{notBefore: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), expires: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if !first.window.notBefore.Equal(want.notBefore) || !first.window.expires.Equal(want.expires) {
+		t.Errorf("window = %+v, want %+v", first.window, want)
+	}
+
+	if !reflect.DeepEqual(first.unknownHeaders, []string{"Comment"}) {
+		t.Errorf("unknown headers = %v, want Comment", first.unknownHeaders)
+	}
+
+	// the key data replaces the alg of the headers
+	keys, _, err = parseKeyData(keysource.KeyData{Data: signer, Alg: "RS256"})
+	if err != nil || keys[0].key.Algorithm() != "RS256" {
+		t.Errorf("parseKeyData() with alg = %v, %v", keys, err)
+	}
+
+	// a strict key id is not replaced by the Kid header
+	if _, _, err := parseKeyData(keysource.KeyData{Kid: "signer-2025", KidStrict: true, Data: signer}); err == nil {
+		t.Errorf("parseKeyData() with a Kid header conflicting with a strict key id must fail")
+	}
+
+	if _, _, err := parseKeyData(keysource.KeyData{Kid: "signer-2024", KidStrict: true, Data: signer}); err != nil {
+		t.Errorf("parseKeyData() with a Kid header matching a strict key id: %v", err)
+	}
+
+	for _, headers := range []map[string]string{{"Use": "sign"}, {"Alg": "XS256"}, {"Exp": "tomorrow"}} {
+		if _, _, err := parseKeyData(keysource.KeyData{Kid: "key", Data: withHeaders(headers)}); err == nil {
+			t.Errorf("parseKeyData() with headers %v must fail", headers)
+		}
+	}
+
+	// the window of the headers is restricted by the one of the key data and the unknown headers are reported
+	source := &staticSource{snapshot: &keysource.Snapshot{Keys: []keysource.KeyData{
+		{Name: "signer.pub", Data: signer, Expires: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+	}}}
+
+	loaded, err := loadKeys(context.Background(), source, nil)
+	if err != nil {
+		t.Fatal("loadKeys() error:", err)
+	}
+
+	if window := loaded.validities["signer-2024"]; !window.notBefore.Equal(want.notBefore) || !window.expires.Equal(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("loaded window = %+v", window)
+	}
+
+	if key, err := LoadPublicKey(signer); err != nil || key.KeyID() != "signer-2024" {
+		t.Errorf("LoadPublicKey() = %v, %v, want the key id of the Kid header", key, err)
+	}
+}
+
+func TestLoadKeysAliases(t *testing.T) {
+	dir := t.TempDir()
+
+	pem1 := readTestPEM(t, dir, "key1")
+	pem2 := readTestPEM(t, dir, "key2")
+
+	now := time.Now()
+
+	source := &staticSource{snapshot: &keysource.Snapshot{Keys: []keysource.KeyData{{
+		Name:      "signer.pub",
+		Kid:       "signer",
+		KidPrefix: "p/",
+		Data:      pem1,
+		Aliases: []keysource.Alias{
+			{Kid: "old"},
+			{Kid: "older", Expires: now.Add(-time.Hour)},
+		},
+	}}}}
+
+	loaded, err := loadKeys(context.Background(), source, nil)
+	if err != nil {
+		t.Fatal("loadKeys() error:", err)
+	}
+
+	signer, _ := loaded.keys.LookupKeyID("p/signer")
+	for _, kid := range []string{"p/old", "p/older"} {
+		alias, ok := loaded.keys.LookupKeyID(kid)
+		if !ok {
+			t.Errorf("alias %s not loaded", kid)
+			continue
+		}
+
+		signerPrint, _ := signer.Thumbprint(crypto.SHA256)
+		aliasPrint, _ := alias.Thumbprint(crypto.SHA256)
+		if !reflect.DeepEqual(signerPrint, aliasPrint) {
+			t.Errorf("alias %s is not the same key material", kid)
+		}
+
+		if info := loaded.infos[kid]; info.AliasOf != "p/signer" || info.Name != "signer.pub" {
+			t.Errorf("alias %s info = %+v", kid, info)
+		}
+	}
+
+	if info := loaded.infos["p/signer"]; info.AliasOf != "" {
+		t.Errorf("the key is marked as an alias of %s", info.AliasOf)
+	}
+
+	// the expired alias is not published, the key and the other alias are
+	published, _ := filterValid(loaded.keys, loaded.validities, now)
+
+	var kids []string
+	for i := 0; i < published.Len(); i++ {
+		key, _ := published.Get(i)
+		kids = append(kids, key.KeyID())
+	}
+
+	if want := []string{"p/signer", "p/old"}; !reflect.DeepEqual(kids, want) {
+		t.Errorf("published = %v, want %v", kids, want)
+	}
+
+	// the aliases of a bundle are ambiguous
+	source.snapshot.Keys[0].Data = append(append([]byte{}, pem1...), pem2...)
+
+	if _, err := loadKeys(context.Background(), source, nil); err == nil {
+		t.Errorf("loadKeys() with the aliases of a bundle must fail")
+	}
+}
+
+// staticSource returns the same snapshot on every fetch
+type staticSource struct {
+	name     string
+	snapshot *keysource.Snapshot
+}
+
+func (s *staticSource) Name() string {
+	if s.name == "" {
+		return "static"
+	}
+
+	return s.name
+}
+
+func (s *staticSource) Fetch(ctx context.Context) (*keysource.Snapshot, error) {
+	return s.snapshot, nil
+}
+
+func (s *staticSource) Watch(ctx context.Context, changed func()) error {
+	<-ctx.Done()
+	return nil
+}
+
+func readTestPEM(t *testing.T, dir, name string) []byte {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	writeTestPEM(t, path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal("failed to read key:", err)
+	}
+
+	return data
+}
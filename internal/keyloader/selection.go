@@ -0,0 +1,167 @@
+package keyloader
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// priorityLabel is the label ordering the keys with SelectionConfig.OrderBy priority, an integer, the highest first
+const priorityLabel = "priority"
+
+// SelectionConfig caps the number of published keys, the keys exceeding the cap are excluded
+type SelectionConfig struct {
+	// the maximum number of published keys, overall or per group, 0 for unlimited
+	MaxKeys int
+
+	// groups the keys, each group keeps up to MaxKeys keys: empty for all the keys together, "source" by key source,
+	// "dir" by directory of the key material name, "label:<name>" by value of the label
+	GroupBy string
+
+	// the order the keys are kept in: "mtime" the newest modification time first, "nbf" the latest start of the
+	// validity window first, "priority" the highest priority label first, the keys without a value come last
+	OrderBy string
+}
+
+func (c *SelectionConfig) Enabled() bool {
+	return c.MaxKeys > 0
+}
+
+func (c *SelectionConfig) Validate() error {
+	if c.MaxKeys < 0 {
+		return errors.New("max-keys must not be negative")
+	}
+
+	switch {
+	case c.GroupBy == "", c.GroupBy == "source", c.GroupBy == "dir":
+	case strings.HasPrefix(c.GroupBy, "label:") && len(c.GroupBy) > len("label:"):
+	default:
+		return fmt.Errorf("max-keys-group-by %s must be source, dir or label:<name>", c.GroupBy)
+	}
+
+	switch c.OrderBy {
+	case "mtime", "nbf", "priority":
+	default:
+		return fmt.Errorf("max-keys-order-by %s must be mtime, nbf or priority", c.OrderBy)
+	}
+
+	return nil
+}
+
+// group returns the group of the key
+func (c *SelectionConfig) group(info KeyInfo) string {
+	switch {
+	case c.GroupBy == "source":
+		return info.Source
+
+	case c.GroupBy == "dir":
+		return path.Dir(info.Name)
+
+	case strings.HasPrefix(c.GroupBy, "label:"):
+		return info.Labels[strings.TrimPrefix(c.GroupBy, "label:")]
+	}
+
+	return ""
+}
+
+// selectionCandidate is a key competing for a place in its group
+type selectionCandidate struct {
+	kid    string
+	info   KeyInfo
+	window validity
+}
+
+// before returns true if the candidate a is kept before b, the ties are broken by modification time then by key id
+func (c *SelectionConfig) before(a, b selectionCandidate) bool {
+	switch c.OrderBy {
+	case "nbf":
+		if !a.window.notBefore.Equal(b.window.notBefore) {
+			return a.window.notBefore.After(b.window.notBefore)
+		}
+
+	case "priority":
+		pa, okA := labelPriority(a.info)
+		pb, okB := labelPriority(b.info)
+
+		if okA != okB {
+			return okA
+		}
+
+		if pa != pb {
+			return pa > pb
+		}
+	}
+
+	if !a.info.ModTime.Equal(b.info.ModTime) {
+		return a.info.ModTime.After(b.info.ModTime)
+	}
+
+	return a.kid < b.kid
+}
+
+// labelPriority returns the priority label of the key, false if it has none or it is not an integer
+func labelPriority(info KeyInfo) (int, bool) {
+	p, err := strconv.Atoi(info.Labels[priorityLabel])
+	if err != nil {
+		return 0, false
+	}
+
+	return p, true
+}
+
+// selectKeys returns the keys kept by the selection and the sorted key ids of the excluded keys,
+// the aliases follow the key they are a copy of and do not count for the cap
+func selectKeys(set jwk.Set, infos map[string]KeyInfo, windows map[string]validity, config SelectionConfig) (jwk.Set, []string) {
+	groups := map[string][]selectionCandidate{}
+
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Get(i)
+
+		info := infos[key.KeyID()]
+		if info.AliasOf != "" {
+			continue
+		}
+
+		group := config.group(info)
+		groups[group] = append(groups[group], selectionCandidate{kid: key.KeyID(), info: info, window: windows[key.KeyID()]})
+	}
+
+	dropped := map[string]bool{}
+
+	for _, candidates := range groups {
+		if len(candidates) <= config.MaxKeys {
+			continue
+		}
+
+		sort.Slice(candidates, func(i, j int) bool { return config.before(candidates[i], candidates[j]) })
+
+		for _, c := range candidates[config.MaxKeys:] {
+			dropped[c.kid] = true
+		}
+	}
+
+	selected := jwk.NewSet()
+
+	var excluded []string
+
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Get(i)
+
+		info := infos[key.KeyID()]
+		if dropped[key.KeyID()] || (info.AliasOf != "" && dropped[info.AliasOf]) {
+			excluded = append(excluded, key.KeyID())
+			continue
+		}
+
+		selected.Add(key)
+	}
+
+	sort.Strings(excluded)
+
+	return selected, excluded
+}
@@ -0,0 +1,120 @@
+package keyloader
+
+import (
+	"go-jwks-server/internal/keysource"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+func TestSelectKeys(t *testing.T) {
+	base := time.Date(2024, 6, 5, 0, 0, 0, 0, time.UTC)
+
+	set := jwk.NewSet()
+	infos := map[string]KeyInfo{}
+	windows := map[string]validity{}
+
+	add := func(kid string, info KeyInfo, nbf time.Time) {
+		set.Add(newTestKey(t, kid))
+		infos[kid] = info
+
+		if !nbf.IsZero() {
+			windows[kid] = validity{notBefore: nbf}
+		}
+	}
+
+	add("a1", KeyInfo{Source: "dir:/keys", Name: "team-a/a1.pub", ModTime: base.Add(1 * time.Hour), Labels: map[string]string{"team": "a", "priority": "1"}}, base.Add(3*time.Hour))
+	add("a2", KeyInfo{Source: "dir:/keys", Name: "team-a/a2.pub", ModTime: base.Add(2 * time.Hour), Labels: map[string]string{"team": "a"}}, base.Add(1*time.Hour))
+	add("a3", KeyInfo{Source: "dir:/keys", Name: "team-a/a3.pub", ModTime: base.Add(3 * time.Hour), Labels: map[string]string{"team": "a", "priority": "5"}}, time.Time{})
+	add("b1", KeyInfo{Source: "manifest:/keys.yaml", Name: "b1", ModTime: base, Labels: map[string]string{"team": "b"}}, time.Time{})
+	add("a2-old", KeyInfo{Source: "dir:/keys", Name: "team-a/a2.pub", AliasOf: "a2"}, time.Time{})
+
+	tests := []struct {
+		config       SelectionConfig
+		wantExcluded []string
+	}{
+		{SelectionConfig{MaxKeys: 2, OrderBy: "mtime"}, []string{"a1", "b1"}},
+		{SelectionConfig{MaxKeys: 1, GroupBy: "label:team", OrderBy: "mtime"}, []string{"a1", "a2", "a2-old"}},
+		{SelectionConfig{MaxKeys: 2, GroupBy: "dir", OrderBy: "nbf"}, []string{"a3"}},
+		{SelectionConfig{MaxKeys: 2, GroupBy: "source", OrderBy: "priority"}, []string{"a2", "a2-old"}},
+		{SelectionConfig{MaxKeys: 4, OrderBy: "mtime"}, nil},
+	}
+
+	for _, tt := range tests {
+		selected, excluded := selectKeys(set, infos, windows, tt.config)
+
+		if !reflect.DeepEqual(excluded, tt.wantExcluded) {
+			t.Errorf("%+v: excluded = %v, want %v", tt.config, excluded, tt.wantExcluded)
+		}
+
+		if selected.Len()+len(excluded) != set.Len() {
+			t.Errorf("%+v: %d selected and %d excluded keys, want %d keys", tt.config, selected.Len(), len(excluded), set.Len())
+		}
+	}
+}
+
+func TestSelectionConfigValidate(t *testing.T) {
+	valid := []SelectionConfig{
+		{OrderBy: "mtime"},
+		{MaxKeys: 3, GroupBy: "label:team", OrderBy: "priority"},
+		{MaxKeys: 3, GroupBy: "dir", OrderBy: "nbf"},
+	}
+
+	for _, c := range valid {
+		if err := c.Validate(); err != nil {
+			t.Errorf("%+v: %v", c, err)
+		}
+	}
+
+	invalid := []SelectionConfig{
+		{MaxKeys: -1, OrderBy: "mtime"},
+		{MaxKeys: 3, GroupBy: "label:", OrderBy: "mtime"},
+		{MaxKeys: 3, GroupBy: "team", OrderBy: "mtime"},
+		{MaxKeys: 3, OrderBy: "newest"},
+	}
+
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v must be invalid", c)
+		}
+	}
+}
+
+func TestPublishSelection(t *testing.T) {
+	now := time.Now()
+
+	keys := jwk.NewSet()
+	keys.Add(newTestKey(t, "old"))
+	keys.Add(newTestKey(t, "new"))
+
+	kl := &Keyloader{
+		config:  Config{Selection: SelectionConfig{MaxKeys: 1, OrderBy: "mtime"}},
+		sources: []keysource.KeySource{keysource.NewDir("/keys", keysource.DirConfig{})},
+		states: []sourceState{
+			{attempted: true, loaded: &sourceKeys{keys: keys, infos: map[string]KeyInfo{
+				"old": {Source: "dir:/keys", Name: "old.pub", ModTime: now.Add(-time.Hour)},
+				"new": {Source: "dir:/keys", Name: "new.pub", ModTime: now},
+			}}},
+		},
+	}
+
+	ch, unsubscribe := kl.Subscribe()
+	defer unsubscribe()
+
+	kl.publish()
+
+	diff := <-ch
+	if !reflect.DeepEqual(diff.Added, []string{"new"}) || !reflect.DeepEqual(diff.Excluded, []string{"old"}) {
+		t.Errorf("diff = %+v, want new added and old excluded", diff)
+	}
+
+	if !reflect.DeepEqual(kl.GetExcludedKeys(), []string{"old"}) {
+		t.Errorf("excluded keys = %v", kl.GetExcludedKeys())
+	}
+
+	if _, ok := kl.GetKeyInfo("old"); ok {
+		t.Errorf("the excluded key must not have an info")
+	}
+}
@@ -0,0 +1,86 @@
+package keyloader
+
+import (
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// validity is the window a key is published in, a zero bound is open
+type validity struct {
+	notBefore time.Time
+	expires   time.Time
+}
+
+func (v validity) unbounded() bool {
+	return v.notBefore.IsZero() && v.expires.IsZero()
+}
+
+// restrict returns the intersection of the windows
+func (v validity) restrict(other validity) validity {
+	if v.notBefore.IsZero() || other.notBefore.After(v.notBefore) {
+		v.notBefore = other.notBefore
+	}
+
+	if v.expires.IsZero() || (!other.expires.IsZero() && other.expires.Before(v.expires)) {
+		v.expires = other.expires
+	}
+
+	return v
+}
+
+// outside returns why the window does not contain now, empty if it does
+func (v validity) outside(now time.Time) string {
+	switch {
+	case !v.notBefore.IsZero() && now.Before(v.notBefore):
+		return "not valid before " + v.notBefore.UTC().Format(time.RFC3339)
+
+	case !v.expires.IsZero() && !now.Before(v.expires):
+		return "expired at " + v.expires.UTC().Format(time.RFC3339)
+	}
+
+	return ""
+}
+
+// next returns the next bound of the window after now, zero if there is none
+func (v validity) next(now time.Time) time.Time {
+	switch {
+	case !v.notBefore.IsZero() && now.Before(v.notBefore):
+		return v.notBefore
+
+	case !v.expires.IsZero() && now.Before(v.expires):
+		return v.expires
+	}
+
+	return time.Time{}
+}
+
+// filterValid returns the keys whose window contains now, and the earliest time a key enters or leaves
+// its window, zero if none does, the set is returned as is if no key has a window
+func filterValid(set jwk.Set, validities map[string]validity, now time.Time) (jwk.Set, time.Time) {
+	if set == nil || len(validities) == 0 {
+		return set, time.Time{}
+	}
+
+	var next time.Time
+
+	filtered := jwk.NewSet()
+
+	for i := 0; i < set.Len(); i++ {
+		key, _ := set.Get(i)
+
+		window := validities[key.KeyID()]
+
+		if t := window.next(now); !t.IsZero() && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+
+		if window.outside(now) != "" {
+			continue
+		}
+
+		filtered.Add(key)
+	}
+
+	return filtered, next
+}
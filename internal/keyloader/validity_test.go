@@ -0,0 +1,52 @@
+package keyloader
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+func TestFilterValid(t *testing.T) {
+	now := time.Date(2024, 6, 5, 12, 0, 0, 0, time.UTC)
+
+	set := jwk.NewSet()
+	for _, kid := range []string{"always", "current", "future", "expired"} {
+		set.Add(newTestKey(t, kid))
+	}
+
+	validities := map[string]validity{
+		"current": {notBefore: now.Add(-time.Hour), expires: now.Add(2 * time.Hour)},
+		"future":  {notBefore: now.Add(time.Hour)},
+		"expired": {expires: now},
+	}
+
+	filtered, next := filterValid(set, validities, now)
+
+	var kids []string
+	for i := 0; i < filtered.Len(); i++ {
+		key, _ := filtered.Get(i)
+		kids = append(kids, key.KeyID())
+	}
+
+	if !reflect.DeepEqual(kids, []string{"always", "current"}) {
+		t.Errorf("published kids = %v", kids)
+	}
+
+	if !next.Equal(now.Add(time.Hour)) {
+		t.Errorf("next check = %s, want the nbf of the future key", next)
+	}
+
+	// after the nbf of the future key the next check is the exp of the current key
+	filtered, next = filterValid(set, validities, now.Add(time.Hour))
+
+	if filtered.Len() != 3 || !next.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("published %d keys, next check %s", filtered.Len(), next)
+	}
+
+	// no windows
+	if filtered, next := filterValid(set, nil, now); filtered != set || !next.IsZero() {
+		t.Errorf("the set without windows must be returned as is")
+	}
+}
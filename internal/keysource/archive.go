@@ -0,0 +1,283 @@
+package keysource
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"go-jwks-server/internal/keyfiles"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxArchiveSize limits the size of an archive and of its uncompressed content, and of the files read without a configured limit
+const maxArchiveSize = 64 << 20
+
+// ArchiveConfig configures an archive source
+type ArchiveConfig struct {
+	// the include, exclude, ignore file and size rules applied to the entries, like to the files of a directory
+	Files keyfiles.Options
+
+	// joins the path elements of an entry in a subdirectory to form the key id
+	KidPathSeparator string
+
+	// the polling interval of the archive file, 0 disables watching
+	WatchInterval time.Duration
+}
+
+// Archive loads the keys from the files of a tar, tar.gz or zip archive, one key in a file like a directory source
+// the archive is read at once and any error fails the whole load, so a replaced archive is a single update
+// and a partially written one keeps the keys of the previous one
+type Archive struct {
+	path   string
+	config ArchiveConfig
+}
+
+func NewArchive(path string, config ArchiveConfig) *Archive {
+	return &Archive{
+		path:   path,
+		config: config,
+	}
+}
+
+func (a *Archive) Name() string {
+	return "archive:" + a.path
+}
+
+// archiveEntry is a regular file of an archive
+type archiveEntry struct {
+	name string
+	info fs.FileInfo
+	data []byte
+}
+
+// Fetch reads the archive, Snapshot.Version is a hash of the archive file
+// the modification time of the keys is the one of their entry, or of the archive file if the entry has none
+func (a *Archive) Fetch(ctx context.Context) (*Snapshot, error) {
+	// a replaced archive is read whole from the old or the new file
+	data, info, err := ReadFile(a.path, maxArchiveSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading archive: %w", err)
+	}
+
+	entries, skipped, err := readArchive(data)
+	if err != nil {
+		return nil, fmt.Errorf("reading archive %s: %w", a.path, err)
+	}
+
+	var ignoreFile []byte
+	if e, ok := entries[a.config.Files.IgnoreFile]; ok && a.config.Files.IgnoreFile != "" {
+		ignoreFile = e.data
+	}
+
+	filter, err := keyfiles.NewEntryFilter(a.config.Files, ignoreFile)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	snapshot := &Snapshot{
+		Skipped: skipped,
+		Version: sha256Hex(data)[:16],
+	}
+
+	for _, name := range names {
+		e := entries[name]
+
+		if skippedPath, reason := filter.Skip(name, e.info); skippedPath != "" {
+			snapshot.Skipped[skippedPath] = reason
+			continue
+		}
+
+		modTime := e.info.ModTime()
+		if modTime.IsZero() {
+			modTime = info.ModTime()
+		}
+
+		snapshot.Keys = append(snapshot.Keys, KeyData{
+			Name:    name,
+			Kid:     KidFromPath(name, a.config.KidPathSeparator),
+			Data:    e.data,
+			ModTime: modTime,
+		})
+	}
+
+	return snapshot, nil
+}
+
+// Watch polls the size and the modification time of the archive file
+func (a *Archive) Watch(ctx context.Context, changed func()) error {
+	return pollFile(ctx, a.path, a.config.WatchInterval, changed, "key archive changed")
+}
+
+// readArchive reads the regular files of a zip, gzip compressed tar or tar archive, by cleaned name
+// the other entries are returned as skipped, the directories are left out
+func readArchive(data []byte) (map[string]archiveEntry, map[string]string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")), bytes.HasPrefix(data, []byte("PK\x05\x06")):
+		return readZip(data)
+
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, fmt.Errorf("gzip: %w", err)
+		}
+
+		// the gzip checksum is verified at the end of the stream, reading the whole tar covers it
+		return readTar(gz)
+
+	default:
+		return readTar(bytes.NewReader(data))
+	}
+}
+
+func readTar(r io.Reader) (map[string]archiveEntry, map[string]string, error) {
+	entries := map[string]archiveEntry{}
+	skipped := map[string]string{}
+
+	tr := tar.NewReader(r)
+	total := int64(0)
+
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("tar: %w", err)
+		}
+
+		name, ok := archiveEntryName(header.Name, skipped)
+		if !ok {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			continue
+
+		case tar.TypeReg, tar.TypeRegA: // nolint:staticcheck
+
+		case tar.TypeSymlink, tar.TypeLink:
+			skipped[name] = "symbolic link"
+			continue
+
+		default:
+			skipped[name] = "not a regular file"
+			continue
+		}
+
+		total += header.Size
+		if total > maxArchiveSize {
+			return nil, nil, fmt.Errorf("content larger than %d bytes", maxArchiveSize)
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("tar %s: %w", name, err)
+		}
+
+		// like tar does on extraction, a later entry replaces an earlier one with the same name
+		entries[name] = archiveEntry{name: name, info: header.FileInfo(), data: data}
+	}
+
+	return entries, skipped, nil
+}
+
+func readZip(data []byte) (map[string]archiveEntry, map[string]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("zip: %w", err)
+	}
+
+	entries := map[string]archiveEntry{}
+	skipped := map[string]string{}
+	total := uint64(0)
+
+	for _, f := range zr.File {
+		name, ok := archiveEntryName(f.Name, skipped)
+		if !ok {
+			continue
+		}
+
+		mode := f.Mode()
+
+		switch {
+		case mode.IsDir():
+			continue
+
+		case mode&fs.ModeSymlink != 0:
+			skipped[name] = "symbolic link"
+			continue
+
+		case !mode.IsRegular():
+			skipped[name] = "not a regular file"
+			continue
+		}
+
+		total += f.UncompressedSize64
+		if total > maxArchiveSize {
+			return nil, nil, fmt.Errorf("content larger than %d bytes", maxArchiveSize)
+		}
+
+		data, err := readZipFile(f)
+		if err != nil {
+			return nil, nil, fmt.Errorf("zip %s: %w", name, err)
+		}
+
+		entries[name] = archiveEntry{name: name, info: f.FileInfo(), data: data}
+	}
+
+	return entries, skipped, nil
+}
+
+// readZipFile reads the content of a zip entry, the checksum is verified by the reader
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return readLimited(rc, int64(f.UncompressedSize64))
+}
+
+// archiveEntryName returns the slash separated path of an entry relative to the root of the archive
+// the entries outside of the root are reported as skipped
+func archiveEntryName(raw string, skipped map[string]string) (string, bool) {
+	name := strings.TrimLeft(path.Clean(raw), "/")
+
+	if name == ".." || strings.HasPrefix(name, "../") {
+		skipped[raw] = "path outside the archive"
+		return "", false
+	}
+
+	return name, name != "." && name != ""
+}
+
+// readLimited reads r, failing if it has more than max bytes
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("larger than %d bytes", max)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,199 @@
+package keysource
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"go-jwks-server/internal/keyfiles"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testFile is an entry of a test archive, an empty content makes a symlink
+type testFile struct {
+	name    string
+	content string
+}
+
+func tarGz(t *testing.T, files []testFile) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+
+	for _, f := range files {
+		header := &tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.content)), ModTime: time.Unix(1717606145, 0)}
+		if f.content == "" {
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = "key1.pub"
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func zipFile(t *testing.T, files []testFile) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+
+	zw := zip.NewWriter(&buf)
+
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := w.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// replaceFile writes the data to a temp file renamed over path
+func replaceFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	files := []testFile{
+		{"./key1.pub", "material1"},
+		{"team-a/key2.pub", "material2"},
+		{"team-a/.hidden", "hidden"},
+		{"key3.ignore", "ignored"},
+		{"key4.bak", "excluded"},
+		{"revoked/key5.pub", "revoked"},
+		{"large.pub", string(bytes.Repeat([]byte("x"), 100))},
+		{"../escape.pub", "outside"},
+		{".keyignore", "revoked/\n"},
+		{"link.pub", ""},
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.tar.gz")
+	replaceFile(t, path, tarGz(t, files))
+
+	config := ArchiveConfig{
+		Files: keyfiles.Options{
+			Recursive:   true,
+			Exclude:     []string{"*.bak"},
+			IgnoreFile:  ".keyignore",
+			MaxFileSize: 50,
+		},
+		KidPathSeparator: ".",
+		WatchInterval:    10 * time.Millisecond,
+	}
+
+	a := NewArchive(path, config)
+
+	snapshot, err := a.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	if want := []string{"key1=material1", "team-a.key2=material2"}; !reflect.DeepEqual(snapshotNames(snapshot), want) {
+		t.Errorf("keys = %v, want %v", snapshotNames(snapshot), want)
+	}
+
+	wantSkipped := map[string]string{
+		".keyignore":     "hidden file",
+		"team-a/.hidden": "hidden file",
+		"key3.ignore":    "ignored file",
+		"key4.bak":       "excluded by pattern '*.bak'",
+		"revoked":        "ignored by .keyignore pattern 'revoked'",
+		"large.pub":      "file too large: 100 bytes, max 50",
+		"../escape.pub":  "path outside the archive",
+		"link.pub":       "symbolic link",
+	}
+	if !reflect.DeepEqual(snapshot.Skipped, wantSkipped) {
+		t.Errorf("skipped = %v, want %v", snapshot.Skipped, wantSkipped)
+	}
+
+	if !snapshot.Keys[0].ModTime.Equal(time.Unix(1717606145, 0)) {
+		t.Errorf("mod time = %s, want the one of the entry", snapshot.Keys[0].ModTime)
+	}
+
+	first := snapshot.Version
+
+	// a zip archive replacing the tarball is noticed and loaded as a whole
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	go a.Watch(ctx, func() { // nolint:errcheck
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	// let the watch see the first archive
+	time.Sleep(50 * time.Millisecond)
+
+	replaceFile(t, path, zipFile(t, []testFile{{"key6.pub", "material6"}, {"team-b/key7.pub", "material7"}}))
+
+	select {
+	case <-changed:
+	case <-ctx.Done():
+		t.Fatal("the replaced archive was not noticed")
+	}
+
+	snapshot, err = a.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	if want := []string{"key6=material6", "team-b.key7=material7"}; !reflect.DeepEqual(snapshotNames(snapshot), want) {
+		t.Errorf("keys = %v, want %v", snapshotNames(snapshot), want)
+	}
+
+	if snapshot.Version == first {
+		t.Errorf("the version must change with the archive")
+	}
+
+	// a truncated archive fails the whole load instead of publishing a part of it
+	data := tarGz(t, files)
+	replaceFile(t, path, data[:len(data)/2])
+
+	if _, err := a.Fetch(context.Background()); err == nil {
+		t.Errorf("fetching a truncated archive must fail")
+	}
+}
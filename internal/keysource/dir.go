@@ -0,0 +1,172 @@
+package keysource
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go-jwks-server/internal/keyfiles"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DirConfig configures a directory source
+type DirConfig struct {
+	// controls how the files are listed
+	Files keyfiles.Options
+
+	// joins the path elements of a file in a subdirectory to form the key id
+	KidPathSeparator string
+
+	// the polling interval, 0 disables watching
+	WatchInterval   time.Duration
+	WatchJitter     float64
+	WatchMaxBackoff time.Duration
+
+	// optional hidden file, touching it forces a reload
+	ReloadTriggerFile string
+}
+
+// Dir loads the keys from the files of a directory, one key in a file
+// the key id is derived from the file name, the .pub extension is removed if present
+type Dir struct {
+	dir    string
+	config DirConfig
+
+	// the hash of the files listed by the last fetch, protected by m
+	m       sync.Mutex
+	fetched []byte
+}
+
+func NewDir(dir string, config DirConfig) *Dir {
+	return &Dir{
+		dir:    dir,
+		config: config,
+	}
+}
+
+func (d *Dir) Name() string {
+	return "dir:" + d.dir
+}
+
+func (d *Dir) Fetch(ctx context.Context) (*Snapshot, error) {
+	// resolve once, so the files are listed and read from the same version of the directory
+	readDir, err := keyfiles.ResolveDir(d.dir, d.config.Files)
+	if err != nil {
+		return nil, fmt.Errorf("resolving dir: %w", err)
+	}
+
+	fileMetadata, skipped, err := keyfiles.GetFileMetadata(readDir, d.config.Files)
+	if err != nil {
+		return nil, fmt.Errorf("getting file metadata: %w", err)
+	}
+
+	hash, err := fileMetadata.Hash()
+	if err != nil {
+		return nil, fmt.Errorf("hashing file metadata: %w", err)
+	}
+
+	snapshot := &Snapshot{
+		Keys:    make([]KeyData, 0, len(fileMetadata)),
+		Skipped: skipped,
+	}
+
+	// the size was checked on the listing, the file may have grown since then
+	maxSize := d.config.Files.MaxFileSize
+	if maxSize <= 0 {
+		maxSize = maxArchiveSize
+	}
+
+	for _, f := range fileMetadata {
+		fullPath := filepath.Join(readDir, filepath.FromSlash(f.Name))
+
+		data, _, err := ReadFile(fullPath, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("reading key file %s: %w", fullPath, err)
+		}
+
+		snapshot.Keys = append(snapshot.Keys, KeyData{
+			Name:    f.Name,
+			Kid:     KidFromPath(f.Name, d.config.KidPathSeparator),
+			Data:    data,
+			ModTime: f.ModTime,
+		})
+	}
+
+	d.m.Lock()
+	d.fetched = hash
+	d.m.Unlock()
+
+	return snapshot, nil
+}
+
+// Watch polls the directory for changes, it blocks until the context is done if watching is disabled
+// the first listing of the watcher is not a change if it matches the last fetch
+func (d *Dir) Watch(ctx context.Context, changed func()) error {
+	if d.config.WatchInterval <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	logger := log.With().Str("dir", d.dir).Logger()
+
+	watcher := keyfiles.NewWatcher()
+	watcher.Options = d.config.Files
+	watcher.TriggerFile = d.config.ReloadTriggerFile
+	watcher.Jitter = d.config.WatchJitter
+	watcher.MaxBackoff = d.config.WatchMaxBackoff
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- watcher.Watch(ctx, d.dir, d.config.WatchInterval)
+	}()
+
+	logger.Info().Dur("interval", d.config.WatchInterval).Msg("started watching directory for changes")
+	defer logger.Info().Msg("stopped watching directory for changes")
+
+	// watcher will close the channel when done
+	for event := range watcher.Events {
+		switch {
+		case event.Error != nil:
+			logger.Error().Err(event.Error).Int("failures", event.Failures).Msg("watcher event error")
+
+		case event.Forced:
+			logger.Info().Str("trigger", d.config.ReloadTriggerFile).Msg("reload triggered by file")
+
+		case d.fetchedFiles(event.Files):
+			continue
+
+		default:
+			logger.Debug().Strs("added", event.Added).Strs("removed", event.Removed).Strs("modified", event.Modified).
+				Msg("directory changed")
+		}
+
+		changed()
+	}
+
+	return <-errCh
+}
+
+// fetchedFiles returns true if the files are the ones listed by the last fetch
+func (d *Dir) fetchedFiles(files keyfiles.FileMetadatas) bool {
+	hash, err := files.Hash()
+	if err != nil {
+		return false
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	return bytes.Equal(hash, d.fetched)
+}
+
+// KidFromPath derives the key id from the slash separated path of a key file relative to the key directory
+// the .pub extension is removed and the path elements are joined with the separator
+func KidFromPath(name string, separator string) string {
+	if strings.HasSuffix(strings.ToLower(name), ".pub") {
+		name = name[:len(name)-4]
+	}
+
+	return strings.Join(strings.Split(name, "/"), separator)
+}
@@ -0,0 +1,54 @@
+package keysource
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDirWatch(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "key1.pub"), []byte("material1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDir(dir, DirConfig{WatchInterval: 10 * time.Millisecond})
+
+	snapshot, err := d.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	if want := []string{"key1=material1"}; !reflect.DeepEqual(snapshotNames(snapshot), want) {
+		t.Errorf("keys = %v, want %v", snapshotNames(snapshot), want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	changed := make(chan struct{}, 10)
+	go d.Watch(ctx, func() { changed <- struct{}{} }) // nolint:errcheck
+
+	// the first listing of the watcher matches the fetch, the keys are not loaded twice
+	time.Sleep(100 * time.Millisecond)
+
+	select {
+	case <-changed:
+		t.Fatal("the fetched files were reported as changed")
+	default:
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "key2.pub"), []byte("material2"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+	case <-ctx.Done():
+		t.Fatal("the new file was not noticed")
+	}
+}
@@ -0,0 +1,533 @@
+package keysource
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the delay before the watch of the prefix is retried after a failure
+var etcdRetryDelay = 5 * time.Second
+
+// errEtcdCompacted is returned by a watch starting at a revision that was compacted
+var errEtcdCompacted = errors.New("revision compacted")
+
+// EtcdConfig configures an etcd source, the etcd v3 API is used through its JSON gateway
+type EtcdConfig struct {
+	// the client urls of the cluster members, tried in order until one responds
+	Endpoints []string
+
+	// the keys under the prefix are loaded, the key id is derived from the key relative to it
+	Prefix string
+
+	// the user of the etcd authentication, no authentication if empty
+	Username string
+	Password string `json:"-"`
+
+	// the CA bundle of the cluster and the client certificate, the system CAs are used if no CA file is set
+	CAFile   string
+	CertFile string
+	KeyFile  string
+
+	// joins the path elements of a key relative to the prefix to form the key id
+	KidPathSeparator string
+
+	// the larger values are skipped, 0 for unlimited
+	MaxValueSize int64
+
+	// the timeout of a request, the watch is not limited
+	Timeout time.Duration
+}
+
+// NewEtcdConfig creates the config with the default values
+func NewEtcdConfig() EtcdConfig {
+	return EtcdConfig{
+		Prefix:  "/jwks/",
+		Timeout: 10 * time.Second,
+	}
+}
+
+// Enabled returns true if endpoints are configured
+func (c *EtcdConfig) Enabled() bool {
+	return len(c.Endpoints) > 0
+}
+
+// Validate checks the config
+func (c *EtcdConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	for _, e := range c.Endpoints {
+		u, err := url.Parse(e)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("etcd-endpoint %s must be an absolute http or https url", e)
+		}
+	}
+
+	if c.Prefix == "" {
+		return errors.New("etcd-prefix is required")
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("etcd-cert-file and etcd-key-file must be provided together")
+	}
+
+	if c.Timeout <= 0 {
+		return errors.New("etcd-timeout must be positive")
+	}
+
+	return nil
+}
+
+// Etcd loads the keys from the values under a key prefix, one key in a value
+// the prefix is watched from the revision of the last fetch, so no change is missed when the watch reconnects
+type Etcd struct {
+	config EtcdConfig
+
+	// without timeout, the watches are long running requests
+	client *http.Client
+
+	// the revision of the last fetch, the endpoint in use and the authentication token, protected by m
+	m        sync.Mutex
+	revision int64
+	endpoint int
+	token    string
+}
+
+// etcdKeyValue is a key value pair of the gateway, the bytes are base64 encoded and the numbers are strings in JSON
+type etcdKeyValue struct {
+	Key         []byte `json:"key"`
+	Value       []byte `json:"value"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+// etcdWatchResult is a message of the watch stream
+type etcdWatchResult struct {
+	Header          etcdHeader `json:"header"`
+	Created         bool       `json:"created"`
+	Canceled        bool       `json:"canceled"`
+	CompactRevision int64      `json:"compact_revision,string"`
+	CancelReason    string     `json:"cancel_reason"`
+	Events          []struct {
+		Type string       `json:"type"`
+		KV   etcdKeyValue `json:"kv"`
+	} `json:"events"`
+}
+
+// NewEtcd creates an etcd source
+func NewEtcd(config EtcdConfig) (*Etcd, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.CAFile != "" || config.CertFile != "" {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+		if config.CAFile != "" {
+			pem, err := os.ReadFile(config.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("reading the CA file of etcd: %w", err)
+			}
+
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificate found in CA file %s", config.CAFile)
+			}
+
+			tlsConfig.RootCAs = pool
+		}
+
+		if config.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("loading the client certificate of etcd: %w", err)
+			}
+
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	return &Etcd{
+		config: config,
+		client: &http.Client{Transport: transport},
+	}, nil
+}
+
+func (e *Etcd) Name() string {
+	return "etcd:" + e.config.Prefix
+}
+
+// Fetch reads all the keys under the prefix, Snapshot.Version is the revision of the read
+func (e *Etcd) Fetch(ctx context.Context) (*Snapshot, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.config.Timeout)
+	defer cancel()
+
+	request := map[string]interface{}{
+		"key":       []byte(e.config.Prefix),
+		"range_end": etcdPrefixEnd([]byte(e.config.Prefix)),
+	}
+
+	var response struct {
+		Header etcdHeader     `json:"header"`
+		KVs    []etcdKeyValue `json:"kvs"`
+	}
+
+	resp, err := e.post(ctx, "/v3/kv/range", request)
+	if err != nil {
+		return nil, fmt.Errorf("reading keys: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("decoding keys: %w", err)
+	}
+
+	snapshot := &Snapshot{
+		Skipped: map[string]string{},
+		Version: strconv.FormatInt(response.Header.Revision, 10),
+	}
+
+	for _, kv := range response.KVs {
+		name := strings.TrimPrefix(strings.TrimPrefix(string(kv.Key), e.config.Prefix), "/")
+
+		if skip, reason := e.skipKey(name, kv); skip {
+			if reason != "" {
+				snapshot.Skipped[name] = reason
+			}
+			continue
+		}
+
+		snapshot.Keys = append(snapshot.Keys, KeyData{
+			Name: name,
+			Kid:  KidFromPath(name, e.config.KidPathSeparator),
+			Data: kv.Value,
+		})
+	}
+
+	e.m.Lock()
+	if response.Header.Revision > e.revision {
+		e.revision = response.Header.Revision
+	}
+	e.m.Unlock()
+
+	return snapshot, nil
+}
+
+// skipKey returns true if the key is not a key of the source, the reason is empty for the directory like keys
+func (e *Etcd) skipKey(name string, kv etcdKeyValue) (bool, string) {
+	switch {
+	case name == "" || strings.HasSuffix(name, "/"):
+		return true, ""
+
+	case strings.HasPrefix(path.Base(name), "."):
+		return true, "hidden key"
+
+	case strings.HasSuffix(name, ".ignore"):
+		return true, "ignored key"
+
+	case e.config.MaxValueSize > 0 && int64(len(kv.Value)) > e.config.MaxValueSize:
+		return true, fmt.Sprintf("value too large: %d bytes, max %d", len(kv.Value), e.config.MaxValueSize)
+	}
+
+	return false, ""
+}
+
+// Watch watches the prefix and calls changed on every change, until the context is done
+// the watch starts after the revision of the last fetch or of the last event, whichever is later, a compacted
+// revision loads the keys again
+func (e *Etcd) Watch(ctx context.Context, changed func()) error {
+	var watched int64
+
+	for ctx.Err() == nil {
+		e.m.Lock()
+		start := e.revision
+		e.m.Unlock()
+
+		if start == 0 {
+			// the keys were never fetched, the watch can not know what was missed
+			changed()
+			sleepCtx(ctx, etcdRetryDelay)
+			continue
+		}
+
+		if watched > start {
+			start = watched
+		}
+
+		log.Debug().Str("prefix", e.config.Prefix).Int64("revision", start+1).Msg("watching")
+
+		err := e.watch(ctx, start+1, func(revision int64) {
+			watched = revision
+			changed()
+		})
+
+		switch {
+		case ctx.Err() != nil:
+			return nil
+
+		case errors.Is(err, errEtcdCompacted):
+			log.Info().Str("prefix", e.config.Prefix).Int64("revision", start+1).Msg("watched revision compacted, loading the keys again")
+			watched = 0
+			changed()
+
+			e.m.Lock()
+			loaded := e.revision > start
+			e.m.Unlock()
+
+			if !loaded {
+				sleepCtx(ctx, etcdRetryDelay)
+			}
+
+		case err != nil:
+			log.Error().Err(err).Str("prefix", e.config.Prefix).Msg("watching failed")
+			sleepCtx(ctx, etcdRetryDelay)
+		}
+	}
+
+	return nil
+}
+
+// watch streams the changes of the prefix from the revision and calls changed with the revision of every change,
+// it returns nil when the server ends the stream
+func (e *Etcd) watch(ctx context.Context, revision int64, changed func(int64)) error {
+	request := map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            []byte(e.config.Prefix),
+			"range_end":      etcdPrefixEnd([]byte(e.config.Prefix)),
+			"start_revision": strconv.FormatInt(revision, 10),
+		},
+	}
+
+	resp, err := e.post(ctx, "/v3/watch", request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+
+	for {
+		var message struct {
+			Result *etcdWatchResult `json:"result"`
+			Error  *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+
+		if err := decoder.Decode(&message); err != nil {
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return nil
+			}
+
+			return fmt.Errorf("decoding the watch response: %w", err)
+		}
+
+		if message.Error != nil {
+			return fmt.Errorf("watch error: %s", message.Error.Message)
+		}
+
+		result := message.Result
+		if result == nil {
+			continue
+		}
+
+		if result.Canceled {
+			if result.CompactRevision > 0 {
+				return errEtcdCompacted
+			}
+
+			return fmt.Errorf("watch canceled: %s", result.CancelReason)
+		}
+
+		if len(result.Events) > 0 {
+			changed(result.Header.Revision)
+		}
+	}
+}
+
+// post sends the request to the endpoint in use, the next endpoints are tried if it does not respond,
+// the token is requested again if it is rejected
+func (e *Etcd) post(ctx context.Context, path string, request interface{}) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("encoding request: %w", err)
+	}
+
+	e.m.Lock()
+	first := e.endpoint
+	e.m.Unlock()
+
+	var lastErr error
+
+	for i := 0; i < len(e.config.Endpoints); i++ {
+		endpoint := (first + i) % len(e.config.Endpoints)
+
+		resp, err := e.postEndpoint(ctx, endpoint, path, body)
+		if err == nil {
+			e.m.Lock()
+			e.endpoint = endpoint
+			e.m.Unlock()
+
+			return resp, nil
+		}
+
+		var statusErr *etcdStatusError
+		if errors.As(err, &statusErr) || ctx.Err() != nil {
+			// the member responded, the request itself failed
+			return nil, err
+		}
+
+		log.Debug().Err(err).Str("endpoint", e.config.Endpoints[endpoint]).Msg("etcd endpoint failed")
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
+
+// etcdStatusError is the error response of a member
+type etcdStatusError struct {
+	status  string
+	message string
+}
+
+func (e *etcdStatusError) Error() string {
+	return fmt.Sprintf("status %s: %s", e.status, e.message)
+}
+
+// postEndpoint sends the request to one endpoint, authenticating first if a user is configured
+func (e *Etcd) postEndpoint(ctx context.Context, endpoint int, path string, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		token, err := e.authenticate(ctx, endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := e.do(ctx, endpoint, path, body, token)
+
+		var statusErr *etcdStatusError
+		if attempt == 0 && token != "" && errors.As(err, &statusErr) && statusErr.status == "401 Unauthorized" {
+			// the token expired
+			e.m.Lock()
+			if e.token == token {
+				e.token = ""
+			}
+			e.m.Unlock()
+
+			continue
+		}
+
+		return resp, err
+	}
+}
+
+// authenticate returns the token of the user, empty without authentication
+func (e *Etcd) authenticate(ctx context.Context, endpoint int) (string, error) {
+	if e.config.Username == "" {
+		return "", nil
+	}
+
+	e.m.Lock()
+	token := e.token
+	e.m.Unlock()
+
+	if token != "" {
+		return token, nil
+	}
+
+	body, err := json.Marshal(map[string]string{"name": e.config.Username, "password": e.config.Password})
+	if err != nil {
+		return "", fmt.Errorf("encoding request: %w", err)
+	}
+
+	authCtx, cancel := context.WithTimeout(ctx, e.config.Timeout)
+	defer cancel()
+
+	resp, err := e.do(authCtx, endpoint, "/v3/auth/authenticate", body, "")
+	if err != nil {
+		return "", fmt.Errorf("authenticating: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var auth struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRemoteBodySize)).Decode(&auth); err != nil {
+		return "", fmt.Errorf("decoding the token: %w", err)
+	}
+
+	e.m.Lock()
+	e.token = auth.Token
+	e.m.Unlock()
+
+	return auth.Token, nil
+}
+
+// do posts the body to the endpoint, the response body must be closed by the caller if there is no error
+func (e *Etcd) do(ctx context.Context, endpoint int, path string, body []byte, token string) (*http.Response, error) {
+	u := strings.TrimSuffix(e.config.Endpoints[endpoint], "/") + path
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-jwks-server")
+
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+
+		var status struct {
+			Message string `json:"message"`
+		}
+
+		json.NewDecoder(io.LimitReader(resp.Body, maxRemoteBodySize)).Decode(&status) // nolint:errcheck
+
+		return nil, &etcdStatusError{status: resp.Status, message: status.Message}
+	}
+
+	return resp, nil
+}
+
+// etcdPrefixEnd returns the end of the range of the keys with the prefix, the first key after them
+func etcdPrefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+
+	// the prefix is all 0xff, the range ends with the last key
+	return []byte{0}
+}
@@ -0,0 +1,470 @@
+package keysource
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd serves the range, watch and authenticate calls of the etcd JSON gateway from an in memory history
+type fakeEtcd struct {
+	m         sync.Mutex
+	kvs       map[string]etcdKeyValue
+	revision  int64
+	history   []etcdKeyValue // the kvs of the changes, a nil value is a delete
+	compacted int64
+	token     string
+	starts    []int64
+
+	// closed and replaced on every change, the streams are ended when generation changes
+	notify     chan struct{}
+	generation int
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{kvs: map[string]etcdKeyValue{}, revision: 1, notify: make(chan struct{})}
+}
+
+// put stores the value, a nil value deletes the key
+func (f *fakeEtcd) put(key string, value []byte) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.putLocked(key, value)
+}
+
+func (f *fakeEtcd) putLocked(key string, value []byte) {
+	f.revision++
+
+	kv := etcdKeyValue{Key: []byte(key), Value: value, ModRevision: f.revision}
+	if value == nil {
+		delete(f.kvs, key)
+	} else {
+		f.kvs[key] = kv
+	}
+
+	f.history = append(f.history, kv)
+
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+// compactAndDrop writes the value, compacts the history and ends the streams, so the watches resume at a compacted revision
+func (f *fakeEtcd) compactAndDrop(key string, value []byte) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.generation++
+	f.putLocked(key, value)
+	f.compacted = f.revision
+}
+
+func (f *fakeEtcd) takeStarts() []int64 {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	starts := f.starts
+	f.starts = nil
+
+	return starts
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Key           []byte `json:"key"`
+		RangeEnd      []byte `json:"range_end"`
+		CreateRequest *struct {
+			Key           []byte `json:"key"`
+			RangeEnd      []byte `json:"range_end"`
+			StartRevision int64  `json:"start_revision,string"`
+		} `json:"create_request"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+
+	f.m.Lock()
+
+	if r.URL.Path == "/v3/auth/authenticate" {
+		token := "token-" + strconv.FormatInt(f.revision, 10)
+		f.token = token
+		f.m.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"token": token}) // nolint:errcheck
+		return
+	}
+
+	if r.Header.Get("Authorization") != f.token {
+		f.m.Unlock()
+		http.Error(w, `{"message":"invalid auth token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		var kvs []etcdKeyValue
+		for _, kv := range f.kvs {
+			if bytes.Compare(kv.Key, request.Key) >= 0 && bytes.Compare(kv.Key, request.RangeEnd) < 0 {
+				kvs = append(kvs, kv)
+			}
+		}
+		sort.Slice(kvs, func(i, j int) bool { return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0 })
+
+		response := map[string]interface{}{
+			"header": map[string]string{"revision": strconv.FormatInt(f.revision, 10)},
+			"kvs":    kvs,
+		}
+		f.m.Unlock()
+
+		json.NewEncoder(w).Encode(response) // nolint:errcheck
+
+	case "/v3/watch":
+		start := request.CreateRequest.StartRevision
+		f.starts = append(f.starts, start)
+		generation := f.generation
+		f.m.Unlock()
+
+		f.stream(w, r, start, generation)
+
+	default:
+		f.m.Unlock()
+		http.NotFound(w, r)
+	}
+}
+
+// stream writes the created message and the events from the start revision, one message per revision
+func (f *fakeEtcd) stream(w http.ResponseWriter, r *http.Request, start int64, generation int) {
+	send := func(result map[string]interface{}) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"result": result}) // nolint:errcheck
+		w.(http.Flusher).Flush()
+	}
+
+	f.m.Lock()
+	header := map[string]string{"revision": strconv.FormatInt(f.revision, 10)}
+	compacted := start <= f.compacted
+	f.m.Unlock()
+
+	send(map[string]interface{}{"header": header, "created": true})
+
+	if compacted {
+		send(map[string]interface{}{"header": header, "canceled": true, "compact_revision": strconv.FormatInt(start, 10)})
+		return
+	}
+
+	next := start
+
+	for {
+		f.m.Lock()
+		if f.generation != generation {
+			f.m.Unlock()
+			return
+		}
+
+		var events []etcdKeyValue
+		for _, kv := range f.history {
+			if kv.ModRevision >= next {
+				events = append(events, kv)
+			}
+		}
+		notify := f.notify
+		f.m.Unlock()
+
+		for _, kv := range events {
+			event := map[string]interface{}{"kv": kv}
+			if kv.Value == nil {
+				event["type"] = "DELETE"
+			}
+
+			send(map[string]interface{}{
+				"header": map[string]string{"revision": strconv.FormatInt(kv.ModRevision, 10)},
+				"events": []interface{}{event},
+			})
+
+			next = kv.ModRevision + 1
+		}
+
+		select {
+		case <-notify:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func TestEtcd(t *testing.T) {
+	etcdRetryDelay = 10 * time.Millisecond
+
+	fake := newFakeEtcd()
+	fake.put("/jwks/key1.pub", []byte("material1"))
+	fake.put("/jwks/team-a/key2", []byte("material2"))
+	fake.put("/jwks/.hidden", []byte("hidden"))
+	fake.put("/jwks/key3.ignore", []byte("ignored"))
+	fake.put("/jwks/large", bytes.Repeat([]byte("x"), 100))
+	fake.put("/jwksother/key", []byte("outside the prefix"))
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	// the first endpoint does not respond
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	config := NewEtcdConfig()
+	config.Endpoints = []string{down.URL, server.URL}
+	config.Username = "jwks"
+	config.Password = "secret"
+	config.KidPathSeparator = "."
+	config.MaxValueSize = 50
+
+	e, err := NewEtcd(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := e.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	if want := []string{"key1=material1", "team-a.key2=material2"}; !reflect.DeepEqual(snapshotNames(snapshot), want) {
+		t.Errorf("keys = %v, want %v", snapshotNames(snapshot), want)
+	}
+
+	wantSkipped := map[string]string{
+		".hidden":     "hidden key",
+		"key3.ignore": "ignored key",
+		"large":       "value too large: 100 bytes, max 50",
+	}
+	if !reflect.DeepEqual(snapshot.Skipped, wantSkipped) {
+		t.Errorf("skipped = %v, want %v", snapshot.Skipped, wantSkipped)
+	}
+
+	if snapshot.Version != "7" {
+		t.Errorf("version = %s, want the revision 7", snapshot.Version)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// like the keyloader, the keys are fetched on every change
+	fetched := make(chan *Snapshot, 10)
+	go e.Watch(ctx, func() { // nolint:errcheck
+		snapshot, err := e.Fetch(ctx)
+		if err != nil {
+			t.Error("fetch:", err)
+			return
+		}
+
+		fetched <- snapshot
+	})
+
+	waitFetch := func(what string) *Snapshot {
+		t.Helper()
+
+		select {
+		case snapshot := <-fetched:
+			return snapshot
+		case <-ctx.Done():
+			t.Fatalf("%s was not noticed", what)
+			return nil
+		}
+	}
+
+	// the token is rejected and requested again
+	fake.m.Lock()
+	fake.token = "rotated"
+	fake.m.Unlock()
+
+	fake.put("/jwks/key1.pub", nil)
+
+	if snapshot := waitFetch("the delete"); len(snapshot.Keys) != 1 || snapshot.Version != "8" {
+		t.Errorf("after the delete: version %s, keys %v", snapshot.Version, snapshotNames(snapshot))
+	}
+
+	if starts := fake.takeStarts(); !reflect.DeepEqual(starts, []int64{8}) {
+		t.Errorf("watch start revisions = %v, want the revision after the fetch", starts)
+	}
+
+	// the watch resumes at a compacted revision, the keys are loaded again and the watch starts after them
+	fake.compactAndDrop("/jwks/key4", []byte("material4"))
+
+	if snapshot := waitFetch("the compaction"); snapshot.Version != "9" || len(snapshot.Keys) != 2 {
+		t.Errorf("after the compaction: version %s, keys %v", snapshot.Version, snapshotNames(snapshot))
+	}
+
+	var starts []int64
+	for deadline := time.Now().Add(time.Second); len(starts) < 2 && time.Now().Before(deadline); {
+		starts = append(starts, fake.takeStarts()...)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !reflect.DeepEqual(starts, []int64{9, 10}) {
+		t.Errorf("watch start revisions = %v, want the compacted revision then the one after the fetch", starts)
+	}
+}
+
+func TestEtcdPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"/jwks/", "/jwks0"},
+		{"a\xff", "b"},
+		{"\xff\xff", "\x00"},
+	}
+
+	for _, tt := range tests {
+		if got := string(etcdPrefixEnd([]byte(tt.prefix))); got != tt.want {
+			t.Errorf("etcdPrefixEnd(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+// freeAddr returns a local address with a free port
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+// TestEtcdServer runs the source against a single member etcd started from the etcd binary
+func TestEtcdServer(t *testing.T) {
+	binary, err := exec.LookPath("etcd")
+	if err != nil {
+		t.Skip("etcd is not installed")
+	}
+
+	clientURL := "http://" + freeAddr(t)
+	peerURL := "http://" + freeAddr(t)
+
+	cmd := exec.Command(binary,
+		"--name", "jwks",
+		"--data-dir", t.TempDir(),
+		"--listen-client-urls", clientURL,
+		"--advertise-client-urls", clientURL,
+		"--listen-peer-urls", peerURL,
+		"--initial-advertise-peer-urls", peerURL,
+		"--initial-cluster", "jwks="+peerURL,
+		"--log-level", "error",
+	)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		cmd.Process.Kill() // nolint:errcheck
+		cmd.Wait()         // nolint:errcheck
+	}()
+
+	call := func(path string, request map[string]string) {
+		t.Helper()
+
+		body, _ := json.Marshal(request)
+
+		resp, err := http.Post(clientURL+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %s", path, resp.Status)
+		}
+	}
+
+	put := func(key, value string) {
+		t.Helper()
+
+		call("/v3/kv/put", map[string]string{
+			"key":   base64.StdEncoding.EncodeToString([]byte(key)),
+			"value": base64.StdEncoding.EncodeToString([]byte(value)),
+		})
+	}
+
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		resp, err := http.Get(clientURL + "/health")
+		if err == nil {
+			resp.Body.Close()
+
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("etcd did not start")
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	put("/jwks/key1.pub", "material1")
+	put("/jwks/team-a/key2", "material2")
+	put("/jwks/key3.ignore", "ignored")
+	put("/jwksother/key", "outside the prefix")
+
+	config := NewEtcdConfig()
+	config.Endpoints = []string{clientURL}
+	config.KidPathSeparator = "."
+
+	e, err := NewEtcd(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := e.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	if want := []string{"key1=material1", "team-a.key2=material2"}; !reflect.DeepEqual(snapshotNames(snapshot), want) {
+		t.Errorf("keys = %v, want %v", snapshotNames(snapshot), want)
+	}
+
+	if want := map[string]string{"key3.ignore": "ignored key"}; !reflect.DeepEqual(snapshot.Skipped, want) {
+		t.Errorf("skipped = %v, want %v", snapshot.Skipped, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	changed := make(chan struct{}, 10)
+	go e.Watch(ctx, func() { changed <- struct{}{} }) // nolint:errcheck
+
+	// a put outside the prefix is not a change, the delete of a key is
+	put("/jwksother/key", "changed")
+	call("/v3/kv/deleterange", map[string]string{"key": base64.StdEncoding.EncodeToString([]byte("/jwks/key1.pub"))})
+
+	select {
+	case <-changed:
+	case <-ctx.Done():
+		t.Fatal("the delete was not noticed")
+	}
+
+	snapshot, err = e.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch after the delete:", err)
+	}
+
+	if want := []string{"team-a.key2=material2"}; !reflect.DeepEqual(snapshotNames(snapshot), want) {
+		t.Errorf("keys after the delete = %v, want %v", snapshotNames(snapshot), want)
+	}
+}
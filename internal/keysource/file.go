@@ -0,0 +1,129 @@
+package keysource
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// File loads the keys from a single bundle file, a JWKS/JWK JSON file or a file with several PEM blocks
+// the keys without a key id in the material get a key id derived from the file name
+type File struct {
+	path     string
+	interval time.Duration
+}
+
+// NewFile creates a file source, the file is polled for changes every interval, 0 disables watching
+func NewFile(path string, interval time.Duration) *File {
+	return &File{
+		path:     path,
+		interval: interval,
+	}
+}
+
+func (f *File) Name() string {
+	return "file:" + f.path
+}
+
+func (f *File) Fetch(ctx context.Context) (*Snapshot, error) {
+	data, info, err := ReadFile(f.path, maxArchiveSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+
+	name := filepath.Base(f.path)
+
+	snapshot := &Snapshot{
+		Keys: []KeyData{{
+			Name:    name,
+			Kid:     strings.TrimSuffix(name, filepath.Ext(name)),
+			Data:    data,
+			ModTime: info.ModTime(),
+		}},
+	}
+
+	return snapshot, nil
+}
+
+// Watch polls the size and the modification time of the file
+func (f *File) Watch(ctx context.Context, changed func()) error {
+	return pollFile(ctx, f.path, f.interval, changed, "key file changed")
+}
+
+// ReadFile reads a file that is opened once, failing if it has more than max bytes
+// the returned info is the one of the open file, so it matches the data even if the file is replaced meanwhile
+func ReadFile(path string, max int64) ([]byte, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if info.Size() > max {
+		return nil, nil, fmt.Errorf("larger than %d bytes", max)
+	}
+
+	data, err := readLimited(f, max)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, info, nil
+}
+
+// pollFile calls changed when the size or the modification time of the file changes, 0 disables polling
+func pollFile(ctx context.Context, path string, interval time.Duration, changed func(), msg string) error {
+	return pollFiles(ctx, func() []string { return []string{path} }, interval, changed, msg)
+}
+
+// pollFiles calls changed when the size or the modification time of one of the files changes, 0 disables polling
+// the paths are listed again on every poll
+func pollFiles(ctx context.Context, paths func() []string, interval time.Duration, changed func(), msg string) error {
+	if interval <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	state := func() string {
+		var states []string
+
+		for _, path := range paths() {
+			info, err := os.Stat(path)
+			if err != nil {
+				states = append(states, err.Error())
+				continue
+			}
+
+			states = append(states, fmt.Sprintf("%s %d %d", path, info.Size(), info.ModTime().UnixNano()))
+		}
+
+		return strings.Join(states, "\n")
+	}
+
+	old := state()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+			if s := state(); s != old {
+				old = s
+				log.Debug().Strs("files", paths()).Msg(msg)
+				changed()
+			}
+		}
+	}
+}
@@ -0,0 +1,28 @@
+package keysource
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key.pub")
+	if err := os.WriteFile(path, []byte("material"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, info, err := ReadFile(path, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "material" || info.Size() != 8 {
+		t.Errorf("data = %q, size %d", data, info.Size())
+	}
+
+	// the limit applies to the open file, not to an earlier listing
+	if _, _, err := ReadFile(path, 7); err == nil {
+		t.Errorf("reading a file over the limit must fail")
+	}
+}
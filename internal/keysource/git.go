@@ -0,0 +1,364 @@
+package keysource
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GitConfig configures a git repository source
+type GitConfig struct {
+	// a local repository or the url of a repository to clone, a local repository is read in place
+	Repo string
+
+	// the branch, tag or commit the keys are read from
+	Ref string
+
+	// only the files under the path within the repository are loaded, empty for the whole tree
+	Path string
+
+	// the directory the clones of the remote repositories are kept in, the temp directory if empty
+	CacheDir string
+
+	// joins the path elements of a file relative to Path to form the key id
+	KidPathSeparator string
+
+	// the larger files are skipped, 0 for unlimited
+	MaxFileSize int64
+
+	// the interval to fetch the repository and check if the ref moved, 0 disables watching
+	PollInterval time.Duration
+
+	// the timeout of a git command, the clone included
+	Timeout time.Duration
+}
+
+// NewGitConfig creates the config with the default values
+func NewGitConfig() GitConfig {
+	return GitConfig{
+		Ref:          "HEAD",
+		PollInterval: 1 * time.Minute,
+		Timeout:      1 * time.Minute,
+	}
+}
+
+// Enabled returns true if a repository is configured
+func (c *GitConfig) Enabled() bool {
+	return c.Repo != ""
+}
+
+// Validate checks the config
+func (c *GitConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	if c.Ref == "" || strings.HasPrefix(c.Ref, "-") {
+		return errors.New("git-ref must be a branch, a tag or a commit")
+	}
+
+	if c.PollInterval < 0 {
+		return errors.New("git-poll-interval must not be negative")
+	}
+
+	if c.Timeout <= 0 {
+		return errors.New("git-timeout must be positive")
+	}
+
+	return nil
+}
+
+// Git loads the keys from the files of a repository at a ref, one key in a file
+// the remote repositories are kept as bare clones and fetched on every check, the keys
+// are loaded again when the ref moves to another commit
+type Git struct {
+	config GitConfig
+
+	// the repository the commands run in, the clone of a remote repository
+	dir    string
+	remote bool
+
+	// serializes the git commands that write the clone, and protects commit
+	m sync.Mutex
+
+	// the commit of the last fetch
+	commit string
+}
+
+// gitEntry is a file listed by ls-tree
+type gitEntry struct {
+	mode   string
+	kind   string
+	object string
+	size   int64
+	path   string
+}
+
+// NewGit creates a repository source, it fails if the git binary is not in the PATH, a remote repository is cloned on the first fetch
+func NewGit(config GitConfig) (*Git, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("the git source needs the git binary: %w", err)
+	}
+
+	config.Path = strings.Trim(path.Clean("/"+config.Path), "/")
+
+	g := &Git{
+		config: config,
+		dir:    config.Repo,
+	}
+
+	if info, err := os.Stat(config.Repo); err != nil || !info.IsDir() {
+		cacheDir := config.CacheDir
+		if cacheDir == "" {
+			cacheDir = os.TempDir()
+		}
+
+		g.remote = true
+		g.dir = filepath.Join(cacheDir, "go-jwks-server-git-"+sha256Hex([]byte(config.Repo))[:16])
+	}
+
+	return g, nil
+}
+
+func (g *Git) Name() string {
+	return "git:" + g.config.Repo + "@" + g.config.Ref
+}
+
+// Fetch updates the clone, resolves the ref and reads the files of the commit
+// Snapshot.Version is the commit and the modification time of the keys is the commit time
+func (g *Git) Fetch(ctx context.Context) (*Snapshot, error) {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	if err := g.update(ctx); err != nil {
+		return nil, err
+	}
+
+	commit, commitTime, err := g.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := g.list(ctx, commit)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		Skipped: map[string]string{},
+		Version: commit,
+	}
+
+	for _, e := range entries {
+		name := strings.TrimPrefix(strings.TrimPrefix(e.path, g.config.Path), "/")
+
+		if reason := g.skipEntry(name, e); reason != "" {
+			snapshot.Skipped[name] = reason
+			continue
+		}
+
+		data, err := g.git(ctx, "cat-file", "blob", e.object)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", e.path, err)
+		}
+
+		snapshot.Keys = append(snapshot.Keys, KeyData{
+			Name:    name,
+			Kid:     KidFromPath(name, g.config.KidPathSeparator),
+			Data:    data,
+			ModTime: commitTime,
+		})
+	}
+
+	g.commit = commit
+
+	return snapshot, nil
+}
+
+// skipEntry returns why the entry is not a key, empty if it is one
+func (g *Git) skipEntry(name string, e gitEntry) string {
+	for _, element := range strings.Split(name, "/") {
+		if strings.HasPrefix(element, ".") {
+			return "hidden file"
+		}
+	}
+
+	switch {
+	case e.kind == "commit":
+		return "submodule"
+
+	case e.mode == "120000":
+		return "symbolic link"
+
+	case e.kind != "blob":
+		return "not a file"
+
+	case strings.HasSuffix(name, ".ignore"):
+		return "ignored file"
+
+	case g.config.MaxFileSize > 0 && e.size > g.config.MaxFileSize:
+		return fmt.Sprintf("file too large: %d bytes, max %d", e.size, g.config.MaxFileSize)
+	}
+
+	return ""
+}
+
+// Watch fetches the repository every PollInterval and calls changed if the ref moved since the last fetch
+func (g *Git) Watch(ctx context.Context, changed func()) error {
+	if g.config.PollInterval <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	ticker := time.NewTicker(g.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+			g.m.Lock()
+			err := g.update(ctx)
+			var commit string
+			if err == nil {
+				commit, _, err = g.resolve(ctx)
+			}
+			same := commit == g.commit
+			g.m.Unlock()
+
+			if err != nil {
+				log.Error().Err(err).Str("repo", g.config.Repo).Msg("checking repository failed")
+				continue
+			}
+
+			if !same {
+				log.Debug().Str("repo", g.config.Repo).Str("ref", g.config.Ref).Str("commit", commit).Msg("ref moved")
+				changed()
+			}
+		}
+	}
+}
+
+// update clones a remote repository on first use and fetches all its branches and tags,
+// a local repository is left as is, the caller must hold m
+func (g *Git) update(ctx context.Context) error {
+	if !g.remote {
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(g.dir, "HEAD")); err != nil {
+		// a clone interrupted before it wrote HEAD is not usable
+		if err := os.RemoveAll(g.dir); err != nil {
+			return fmt.Errorf("removing incomplete clone: %w", err)
+		}
+
+		if _, err := g.run(ctx, "", "clone", "--bare", "--quiet", "--", g.config.Repo, g.dir); err != nil {
+			return fmt.Errorf("cloning: %w", err)
+		}
+
+		return nil
+	}
+
+	if _, err := g.git(ctx, "fetch", "--quiet", "--prune", "--force", "origin",
+		"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"); err != nil {
+		return fmt.Errorf("fetching: %w", err)
+	}
+
+	return nil
+}
+
+// resolve returns the commit the ref points to and its time
+func (g *Git) resolve(ctx context.Context) (string, time.Time, error) {
+	out, err := g.git(ctx, "show", "-s", "--format=%H %ct", g.config.Ref+"^{commit}", "--")
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("resolving %s: %w", g.config.Ref, err)
+	}
+
+	commit, seconds, _ := strings.Cut(strings.TrimSpace(string(out)), " ")
+
+	unix, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("resolving %s: invalid commit time %q", g.config.Ref, seconds)
+	}
+
+	return commit, time.Unix(unix, 0), nil
+}
+
+// list returns the files under Path in the tree of the commit
+func (g *Git) list(ctx context.Context, commit string) ([]gitEntry, error) {
+	args := []string{"ls-tree", "-r", "-z", "--long", "--full-tree", commit}
+	if g.config.Path != "" {
+		args = append(args, "--", g.config.Path)
+	}
+
+	out, err := g.git(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("listing files: %w", err)
+	}
+
+	var entries []gitEntry
+
+	for _, line := range bytes.Split(out, []byte{0}) {
+		if len(line) == 0 {
+			continue
+		}
+
+		// <mode> SP <type> SP <object> SP+ <size> TAB <path>
+		info, name, found := strings.Cut(string(line), "\t")
+		fields := strings.Fields(info)
+		if !found || len(fields) != 4 {
+			return nil, fmt.Errorf("listing files: unexpected entry %q", line)
+		}
+
+		// the size of the submodules is -
+		size, _ := strconv.ParseInt(fields[3], 10, 64)
+
+		entries = append(entries, gitEntry{mode: fields[0], kind: fields[1], object: fields[2], size: size, path: name})
+	}
+
+	return entries, nil
+}
+
+// git runs a git command in the repository
+func (g *Git) git(ctx context.Context, args ...string) ([]byte, error) {
+	return g.run(ctx, g.dir, args...)
+}
+
+// run runs a git command with the timeout, never prompting for credentials, the error includes the output of the command
+func (g *Git) run(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, g.config.Timeout)
+	defer cancel()
+
+	command := args[0]
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %w: %s", command, err, msg)
+		}
+
+		return nil, fmt.Errorf("git %s: %w", command, err)
+	}
+
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,199 @@
+package keysource
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRepo is a work tree pushing to a local bare repository
+type testRepo struct {
+	t    *testing.T
+	work string
+	bare string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	r := &testRepo{t: t, work: t.TempDir(), bare: t.TempDir()}
+
+	r.git(r.bare, "init", "--quiet", "--bare", "--initial-branch=main")
+	r.git(r.work, "init", "--quiet", "--initial-branch=main")
+	r.git(r.work, "remote", "add", "origin", r.bare)
+
+	return r
+}
+
+func (r *testRepo) git(dir string, args ...string) string {
+	r.t.Helper()
+
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+// commit writes the files, an empty content removes the file, and pushes the commit, it returns the commit
+func (r *testRepo) commit(files map[string]string) string {
+	r.t.Helper()
+
+	for name, content := range files {
+		path := filepath.Join(r.work, name)
+
+		if content == "" {
+			r.git(r.work, "rm", "--quiet", name)
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			r.t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+
+	r.git(r.work, "add", "--all")
+	r.git(r.work, "commit", "--quiet", "--message", "keys")
+	r.git(r.work, "push", "--quiet", "origin", "main")
+
+	return r.git(r.work, "rev-parse", "HEAD")
+}
+
+func snapshotNames(snapshot *Snapshot) []string {
+	var names []string
+	for _, kd := range snapshot.Keys {
+		names = append(names, kd.Kid+"="+string(kd.Data))
+	}
+
+	return names
+}
+
+func TestGitFetch(t *testing.T) {
+	repo := newTestRepo(t)
+
+	first := repo.commit(map[string]string{
+		"README.md":            "not a key",
+		"keys/key1.pub":        "material1",
+		"keys/team-a/key2.pub": "material2",
+		"keys/.hidden":         "hidden",
+		"keys/key3.ignore":     "ignored",
+		"keys/large.pub":       strings.Repeat("x", 100),
+	})
+	repo.git(repo.work, "tag", "v1")
+	repo.git(repo.work, "push", "--quiet", "origin", "v1")
+
+	config := NewGitConfig()
+	config.Repo = "file://" + repo.bare
+	config.Ref = "main"
+	config.Path = "/keys/"
+	config.CacheDir = t.TempDir()
+	config.KidPathSeparator = "."
+	config.MaxFileSize = 50
+	config.PollInterval = 10 * time.Millisecond
+	config.Timeout = 10 * time.Second
+
+	g, err := NewGit(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := g.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	if want := []string{"key1=material1", "team-a.key2=material2"}; !reflect.DeepEqual(snapshotNames(snapshot), want) {
+		t.Errorf("keys = %v, want %v", snapshotNames(snapshot), want)
+	}
+
+	wantSkipped := map[string]string{
+		".hidden":     "hidden file",
+		"key3.ignore": "ignored file",
+		"large.pub":   "file too large: 100 bytes, max 50",
+	}
+	if !reflect.DeepEqual(snapshot.Skipped, wantSkipped) {
+		t.Errorf("skipped = %v, want %v", snapshot.Skipped, wantSkipped)
+	}
+
+	if snapshot.Version != first {
+		t.Errorf("version = %s, want the commit %s", snapshot.Version, first)
+	}
+
+	if snapshot.Keys[0].ModTime.IsZero() {
+		t.Errorf("the modification time must be the commit time")
+	}
+
+	// a new commit on the branch is noticed and loaded
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	go g.Watch(ctx, func() { // nolint:errcheck
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	second := repo.commit(map[string]string{"keys/key1.pub": "", "keys/key4.pub": "material4"})
+
+	select {
+	case <-changed:
+	case <-ctx.Done():
+		t.Fatal("the new commit was not noticed")
+	}
+
+	snapshot, err = g.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	if want := []string{"key4=material4", "team-a.key2=material2"}; !reflect.DeepEqual(snapshotNames(snapshot), want) {
+		t.Errorf("keys = %v, want %v", snapshotNames(snapshot), want)
+	}
+
+	if snapshot.Version != second {
+		t.Errorf("version = %s, want the commit %s", snapshot.Version, second)
+	}
+
+	// a tag stays on its commit, the bare repository is read in place
+	config.Repo = repo.bare
+	config.Ref = "v1"
+
+	g, _ = NewGit(config)
+
+	snapshot, err = g.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	if snapshot.Version != first || len(snapshot.Keys) != 2 || snapshot.Keys[0].Kid != "key1" {
+		t.Errorf("tag v1: version %s, keys %v", snapshot.Version, snapshotNames(snapshot))
+	}
+
+	config.Ref = "missing"
+
+	g, _ = NewGit(config)
+
+	if _, err := g.Fetch(context.Background()); err == nil {
+		t.Errorf("fetching a missing ref must fail")
+	}
+}
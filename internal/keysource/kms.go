@@ -0,0 +1,442 @@
+package keysource
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// kmsAlgorithms maps the signing algorithms of AWS KMS to the JWK algorithms
+var kmsAlgorithms = map[string]string{
+	"RSASSA_PKCS1_V1_5_SHA_256": "RS256",
+	"RSASSA_PKCS1_V1_5_SHA_384": "RS384",
+	"RSASSA_PKCS1_V1_5_SHA_512": "RS512",
+	"RSASSA_PSS_SHA_256":        "PS256",
+	"RSASSA_PSS_SHA_384":        "PS384",
+	"RSASSA_PSS_SHA_512":        "PS512",
+	"ECDSA_SHA_256":             "ES256",
+	"ECDSA_SHA_384":             "ES384",
+	"ECDSA_SHA_512":             "ES512",
+}
+
+// KMSConfig configures an AWS KMS source, or a KMS compatible emulator with Endpoint
+type KMSConfig struct {
+	// the url of the service, empty for AWS KMS in Region
+	Endpoint string
+
+	Region string
+
+	// the credentials, the AWS environment variables are used if empty
+	Credentials AWSCredentials
+
+	// the key ids, ARNs or alias names of the keys to publish
+	KeyIDs []string
+
+	// the keys with an alias starting with the prefix are published too, with or without the alias/ prefix
+	AliasPrefix string
+
+	// the JWK algorithms in order of preference, the first one supported by a key is its alg
+	Algorithms []string
+
+	// the interval to read the keys again, 0 disables watching
+	PollInterval time.Duration
+
+	// the timeout of a request
+	Timeout time.Duration
+}
+
+// NewKMSConfig creates the config with the default values
+func NewKMSConfig() KMSConfig {
+	return KMSConfig{
+		Region:       "us-east-1",
+		Algorithms:   []string{"RS256", "PS256", "ES256", "ES384", "ES512", "RS384", "PS384", "RS512", "PS512"},
+		PollInterval: 5 * time.Minute,
+		Timeout:      10 * time.Second,
+	}
+}
+
+// Enabled returns true if a key id or an alias prefix is configured
+func (c *KMSConfig) Enabled() bool {
+	return len(c.KeyIDs) > 0 || c.AliasPrefix != ""
+}
+
+// Validate checks the config
+func (c *KMSConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	if c.Region == "" {
+		return errors.New("kms-region is required")
+	}
+
+	if c.Endpoint != "" {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("kms-endpoint %s must be an absolute http or https url", c.Endpoint)
+		}
+	}
+
+	for _, id := range c.KeyIDs {
+		if id == "" {
+			return errors.New("kms-key-id must not be empty")
+		}
+	}
+
+	for _, alg := range c.Algorithms {
+		if !kmsKnownAlgorithm(alg) {
+			return fmt.Errorf("kms-algorithms: unsupported algorithm %s", alg)
+		}
+	}
+
+	if len(c.Algorithms) == 0 {
+		return errors.New("kms-algorithms must not be empty")
+	}
+
+	if c.PollInterval < 0 {
+		return errors.New("kms-poll-interval must not be negative")
+	}
+
+	if c.Timeout <= 0 {
+		return errors.New("kms-timeout must be positive")
+	}
+
+	return nil
+}
+
+func kmsKnownAlgorithm(alg string) bool {
+	for _, known := range kmsAlgorithms {
+		if alg == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+// KMS publishes the public keys of asymmetric KMS signing keys, the key id is the id of the KMS key
+// the disabled keys and the keys pending deletion are skipped
+type KMS struct {
+	config KMSConfig
+	client *http.Client
+
+	// the signature of the keys read by the last fetch, protected by m
+	m    sync.Mutex
+	sign string
+}
+
+// kmsKeyMetadata is the part of the DescribeKey response used by the source
+type kmsKeyMetadata struct {
+	KeyID        string  `json:"KeyId"`
+	KeyState     string  `json:"KeyState"`
+	KeyUsage     string  `json:"KeyUsage"`
+	CreationDate float64 `json:"CreationDate"`
+}
+
+// kmsError is the error response of the JSON API
+type kmsError struct {
+	status  string
+	kind    string
+	message string
+}
+
+func (e *kmsError) Error() string {
+	return fmt.Sprintf("status %s: %s: %s", e.status, e.kind, e.message)
+}
+
+// NewKMS creates a KMS source
+func NewKMS(config KMSConfig) (*KMS, error) {
+	config.Credentials = config.Credentials.orEnv()
+
+	if config.AliasPrefix != "" && !strings.HasPrefix(config.AliasPrefix, "alias/") {
+		config.AliasPrefix = "alias/" + config.AliasPrefix
+	}
+
+	client, err := NewHTTPClient(RemoteConfig{Timeout: config.Timeout})
+	if err != nil {
+		return nil, err
+	}
+
+	return &KMS{
+		config: config,
+		client: client,
+	}, nil
+}
+
+func (k *KMS) Name() string {
+	names := append([]string(nil), k.config.KeyIDs...)
+	if k.config.AliasPrefix != "" {
+		names = append(names, k.config.AliasPrefix+"*")
+	}
+
+	return "kms:" + k.config.Region + "/" + strings.Join(names, ",")
+}
+
+// Fetch reads the public key of every configured key and of every key with an alias starting with the prefix
+func (k *KMS) Fetch(ctx context.Context) (*Snapshot, error) {
+	snapshot, err := k.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	k.m.Lock()
+	k.sign = keysSignature(snapshot.Keys)
+	k.m.Unlock()
+
+	return snapshot, nil
+}
+
+// read returns the public keys, the name of a key is the configured key id or the alias it was found with
+func (k *KMS) read(ctx context.Context) (*Snapshot, error) {
+	names := append([]string(nil), k.config.KeyIDs...)
+
+	if k.config.AliasPrefix != "" {
+		aliases, err := k.listAliases(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, aliases...)
+	}
+
+	snapshot := &Snapshot{
+		Skipped: map[string]string{},
+	}
+
+	// the name every key was first found with, by KMS key id
+	seen := map[string]string{}
+
+	for _, name := range names {
+		var metadata struct {
+			KeyMetadata kmsKeyMetadata `json:"KeyMetadata"`
+		}
+
+		err := k.call(ctx, "DescribeKey", map[string]string{"KeyId": name}, &metadata)
+
+		var apiErr *kmsError
+		if errors.As(err, &apiErr) && apiErr.kind == "NotFoundException" {
+			snapshot.Skipped[name] = "key not found"
+			continue
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("describing key %s: %w", name, err)
+		}
+
+		key := metadata.KeyMetadata
+
+		if first, ok := seen[key.KeyID]; ok {
+			snapshot.Skipped[name] = "same key as " + first
+			continue
+		}
+
+		seen[key.KeyID] = name
+
+		if key.KeyState != "Enabled" {
+			snapshot.Skipped[name] = "key state " + key.KeyState
+			continue
+		}
+
+		if key.KeyUsage != "SIGN_VERIFY" {
+			snapshot.Skipped[name] = "key usage " + key.KeyUsage
+			continue
+		}
+
+		var public struct {
+			PublicKey         []byte   `json:"PublicKey"`
+			KeySpec           string   `json:"KeySpec"`
+			SigningAlgorithms []string `json:"SigningAlgorithms"`
+		}
+
+		if err := k.call(ctx, "GetPublicKey", map[string]string{"KeyId": key.KeyID}, &public); err != nil {
+			return nil, fmt.Errorf("getting the public key of %s: %w", name, err)
+		}
+
+		// the secp256k1 curve is not supported by crypto/x509, publishing the key would fail the source
+		if public.KeySpec == "ECC_SECG_P256K1" {
+			snapshot.Skipped[name] = "key spec ECC_SECG_P256K1 is not supported"
+			continue
+		}
+
+		alg := k.algorithm(public.SigningAlgorithms)
+		if alg == "" {
+			snapshot.Skipped[name] = "no supported signing algorithm: " + strings.Join(public.SigningAlgorithms, ", ")
+			continue
+		}
+
+		seconds, fraction := math.Modf(key.CreationDate)
+
+		snapshot.Keys = append(snapshot.Keys, KeyData{
+			Name:    name,
+			Kid:     key.KeyID,
+			Data:    pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public.PublicKey}),
+			ModTime: time.Unix(int64(seconds), int64(fraction*1e9)),
+			Alg:     alg,
+			Use:     "sig",
+		})
+	}
+
+	return snapshot, nil
+}
+
+// algorithm returns the first configured algorithm the key supports, empty if none
+func (k *KMS) algorithm(signingAlgorithms []string) string {
+	supported := map[string]bool{}
+
+	for _, a := range signingAlgorithms {
+		if alg := kmsAlgorithms[a]; alg != "" {
+			supported[alg] = true
+		}
+	}
+
+	for _, alg := range k.config.Algorithms {
+		if supported[alg] {
+			return alg
+		}
+	}
+
+	return ""
+}
+
+// listAliases returns the aliases starting with the prefix that point to a key
+func (k *KMS) listAliases(ctx context.Context) ([]string, error) {
+	var aliases []string
+	var marker string
+
+	for {
+		request := map[string]string{}
+		if marker != "" {
+			request["Marker"] = marker
+		}
+
+		var response struct {
+			Aliases []struct {
+				AliasName   string `json:"AliasName"`
+				TargetKeyID string `json:"TargetKeyId"`
+			} `json:"Aliases"`
+			NextMarker string `json:"NextMarker"`
+			Truncated  bool   `json:"Truncated"`
+		}
+
+		if err := k.call(ctx, "ListAliases", request, &response); err != nil {
+			return nil, fmt.Errorf("listing aliases: %w", err)
+		}
+
+		for _, a := range response.Aliases {
+			if a.TargetKeyID != "" && strings.HasPrefix(a.AliasName, k.config.AliasPrefix) {
+				aliases = append(aliases, a.AliasName)
+			}
+		}
+
+		if !response.Truncated || response.NextMarker == "" {
+			return aliases, nil
+		}
+
+		marker = response.NextMarker
+	}
+}
+
+// Watch reads the keys every PollInterval and calls changed if a key was added, removed or disabled
+func (k *KMS) Watch(ctx context.Context, changed func()) error {
+	if k.config.PollInterval <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	ticker := time.NewTicker(k.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+			snapshot, err := k.read(ctx)
+			if err != nil {
+				log.Error().Err(err).Msg("reading the KMS keys failed")
+				continue
+			}
+
+			k.m.Lock()
+			same := keysSignature(snapshot.Keys) == k.sign
+			k.m.Unlock()
+
+			if !same {
+				log.Debug().Msg("KMS keys changed")
+				changed()
+			}
+		}
+	}
+}
+
+// call makes a signed request to the JSON API and decodes the response into out
+func (k *KMS) call(ctx context.Context, action string, request interface{}, out interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("encoding request: %w", err)
+	}
+
+	endpoint := k.config.Endpoint
+	if endpoint == "" {
+		endpoint = "https://kms." + k.config.Region + ".amazonaws.com"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+
+	if k.config.Credentials.AccessKeyID != "" {
+		signV4(req, body, k.config.Credentials, k.config.Region, "kms", time.Now())
+	}
+
+	req.Header.Set("User-Agent", "go-jwks-server")
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteBodySize))
+	if err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+
+		json.Unmarshal(respBody, &apiErr) // nolint:errcheck
+
+		// the type can be prefixed with a namespace, like com.amazonaws.kms#NotFoundException
+		kind := apiErr.Type
+		if i := strings.LastIndex(kind, "#"); i >= 0 {
+			kind = kind[i+1:]
+		}
+
+		return &kmsError{status: resp.Status, kind: kind, message: apiErr.Message}
+	}
+
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,252 @@
+package keysource
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKMSKey is a key of the fake KMS
+type fakeKMSKey struct {
+	state      string
+	usage      string
+	spec       string
+	algorithms []string
+	public     []byte
+}
+
+// fakeKMS serves the ListAliases, DescribeKey and GetPublicKey actions of the KMS JSON API
+type fakeKMS struct {
+	m       sync.Mutex
+	keys    map[string]*fakeKMSKey
+	aliases map[string]string
+	authErr bool
+}
+
+func (f *fakeKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+		!strings.Contains(r.Header.Get("Authorization"), "/us-west-2/kms/aws4_request") {
+		f.authErr = true
+		http.Error(w, `{"__type":"UnrecognizedClientException","message":"no signature"}`, http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		KeyID  string `json:"KeyId"`
+		Marker string `json:"Marker"`
+	}
+
+	json.NewDecoder(r.Body).Decode(&request) // nolint:errcheck
+
+	// the keys can be referenced by id or by alias
+	id := request.KeyID
+	if target, ok := f.aliases[id]; ok {
+		id = target
+	}
+
+	key, found := f.keys[id]
+
+	switch r.Header.Get("X-Amz-Target") {
+	case "TrentService.ListAliases":
+		// one alias per page
+		var names []string
+		for name := range f.aliases {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		i := 0
+		for i < len(names) && request.Marker != "" && names[i] != request.Marker {
+			i++
+		}
+
+		response := map[string]interface{}{
+			"Aliases": []interface{}{map[string]string{"AliasName": names[i], "TargetKeyId": f.aliases[names[i]]}},
+		}
+		if i+1 < len(names) {
+			response["Truncated"] = true
+			response["NextMarker"] = names[i+1]
+		}
+
+		json.NewEncoder(w).Encode(response) // nolint:errcheck
+
+	case "TrentService.DescribeKey":
+		if !found {
+			http.Error(w, `{"__type":"NotFoundException","message":"key not found"}`, http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{ // nolint:errcheck
+			"KeyMetadata": map[string]interface{}{
+				"KeyId":        id,
+				"KeyState":     key.state,
+				"KeyUsage":     key.usage,
+				"CreationDate": 1717606145.5,
+			},
+		})
+
+	case "TrentService.GetPublicKey":
+		json.NewEncoder(w).Encode(map[string]interface{}{ // nolint:errcheck
+			"KeyId":             "arn:aws:kms:us-west-2:111122223333:key/" + id,
+			"PublicKey":         key.public,
+			"KeySpec":           key.spec,
+			"SigningAlgorithms": key.algorithms,
+		})
+
+	default:
+		http.Error(w, `{"__type":"UnknownOperationException"}`, http.StatusBadRequest)
+	}
+}
+
+func TestKMS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaDER, _ := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	ecDER, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+
+	// a secp256k1 public key as returned by KMS for an ECC_SECG_P256K1 key
+	k1DER, _ := base64.StdEncoding.DecodeString("MFYwEAYHKoZIzj0CAQYFK4EEAAoDQgAETHWyh+hHgPUyQ7BsjkPtOcNDUw4fj7y5z9iL47HNahi2mW6aUm1zIsXlrW8t4BAU0m+rzPthad7A/4KaVm3sJQ==")
+	if _, err := x509.ParsePKIXPublicKey(k1DER); err == nil {
+		t.Fatal("the secp256k1 key is expected to be unsupported by crypto/x509")
+	}
+
+	rsaAlgorithms := []string{"RSASSA_PSS_SHA_256", "RSASSA_PSS_SHA_384", "RSASSA_PKCS1_V1_5_SHA_256"}
+
+	fake := &fakeKMS{
+		keys: map[string]*fakeKMSKey{
+			"rsa-id":      {state: "Enabled", usage: "SIGN_VERIFY", spec: "RSA_2048", algorithms: rsaAlgorithms, public: rsaDER},
+			"ec-id":       {state: "Enabled", usage: "SIGN_VERIFY", spec: "ECC_NIST_P384", algorithms: []string{"ECDSA_SHA_384"}, public: ecDER},
+			"disabled-id": {state: "Disabled", usage: "SIGN_VERIFY", spec: "RSA_2048", algorithms: rsaAlgorithms, public: rsaDER},
+			"encrypt-id":  {state: "Enabled", usage: "ENCRYPT_DECRYPT", spec: "RSA_2048", public: rsaDER},
+			"sm2-id":      {state: "Enabled", usage: "SIGN_VERIFY", spec: "SM2", algorithms: []string{"SM2DSA"}, public: ecDER},
+			"k1-id":       {state: "Enabled", usage: "SIGN_VERIFY", spec: "ECC_SECG_P256K1", algorithms: []string{"ECDSA_SHA_256"}, public: k1DER},
+		},
+		aliases: map[string]string{
+			"alias/jwt-ec":       "ec-id",
+			"alias/jwt-disabled": "disabled-id",
+			"alias/jwt-rsa":      "rsa-id",
+			"alias/other":        "encrypt-id",
+		},
+	}
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	config := NewKMSConfig()
+	config.Endpoint = server.URL
+	config.Region = "us-west-2"
+	config.Credentials = AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	config.KeyIDs = []string{"rsa-id", "encrypt-id", "sm2-id", "k1-id", "missing-id"}
+	config.AliasPrefix = "jwt-"
+	config.PollInterval = 10 * time.Millisecond
+
+	k, err := NewKMS(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := k.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	if fake.authErr {
+		t.Fatal("the requests were not signed")
+	}
+
+	var got []string
+	for _, kd := range snapshot.Keys {
+		got = append(got, kd.Name+" "+kd.Kid+" "+kd.Alg+" "+kd.Use)
+
+		if block, _ := pem.Decode(kd.Data); block == nil || block.Type != "PUBLIC KEY" {
+			t.Errorf("key %s is not a PEM public key", kd.Name)
+		}
+
+		if !kd.ModTime.Equal(time.Unix(1717606145, 5e8)) {
+			t.Errorf("key %s mod time = %s, want the creation date", kd.Name, kd.ModTime)
+		}
+	}
+
+	// RS256 is preferred to PS256, the RSA key is found by id first
+	if want := []string{"rsa-id rsa-id RS256 sig", "alias/jwt-ec ec-id ES384 sig"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys = %v, want %v", got, want)
+	}
+
+	wantSkipped := map[string]string{
+		"encrypt-id":         "key usage ENCRYPT_DECRYPT",
+		"sm2-id":             "no supported signing algorithm: SM2DSA",
+		"k1-id":              "key spec ECC_SECG_P256K1 is not supported",
+		"missing-id":         "key not found",
+		"alias/jwt-disabled": "key state Disabled",
+		"alias/jwt-rsa":      "same key as rsa-id",
+	}
+	if !reflect.DeepEqual(snapshot.Skipped, wantSkipped) {
+		t.Errorf("skipped = %v, want %v", snapshot.Skipped, wantSkipped)
+	}
+
+	// enabling a key is noticed
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	go k.Watch(ctx, func() { // nolint:errcheck
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	fake.m.Lock()
+	fake.keys["disabled-id"].state = "Enabled"
+	fake.m.Unlock()
+
+	select {
+	case <-changed:
+	case <-ctx.Done():
+		t.Fatal("the enabled key was not noticed")
+	}
+}
+
+func TestKMSAlgorithm(t *testing.T) {
+	k := &KMS{config: KMSConfig{Algorithms: []string{"PS256", "ES256"}}}
+
+	tests := []struct {
+		algorithms []string
+		want       string
+	}{
+		{[]string{"RSASSA_PKCS1_V1_5_SHA_256", "RSASSA_PSS_SHA_256"}, "PS256"},
+		{[]string{"RSASSA_PKCS1_V1_5_SHA_256"}, ""},
+		{[]string{"ECDSA_SHA_256"}, "ES256"},
+	}
+
+	for _, tt := range tests {
+		if got := k.algorithm(tt.algorithms); got != tt.want {
+			t.Errorf("algorithm(%v) = %q, want %q", tt.algorithms, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package keysource
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+// the files of the service account of the pod, used in cluster
+const (
+	serviceAccountDir       = "/var/run/secrets/kubernetes.io/serviceaccount"
+	serviceAccountToken     = serviceAccountDir + "/token"
+	serviceAccountCA        = serviceAccountDir + "/ca.crt"
+	serviceAccountNamespace = serviceAccountDir + "/namespace"
+)
+
+// the resources the keys can be loaded from
+const (
+	KubeSecrets    = "secrets"
+	KubeConfigMaps = "configmaps"
+)
+
+// KubernetesConfig configures a Kubernetes API source
+type KubernetesConfig struct {
+	// the Secrets and ConfigMaps matching the selector are loaded, required
+	LabelSelector string
+
+	// the namespaces to load the keys from, the namespace of the pod if empty
+	Namespaces []string
+
+	// the resources to load the keys from, secrets and/or configmaps
+	Resources []string
+
+	// text/template of the key id, with the fields Namespace, Kind, Name and Key (the data key without the .pub extension)
+	KidTemplate string
+
+	// the url of the API server, the in cluster address if empty
+	APIServer string
+
+	// the bearer token file, reloaded periodically by the client, and the CA bundle of the API server,
+	// the files of the service account are used in cluster if empty
+	TokenFile string
+	CAFile    string
+
+	// the timeout of the list requests
+	Timeout time.Duration
+}
+
+// NewKubernetesConfig creates the config with the default values
+func NewKubernetesConfig() KubernetesConfig {
+	return KubernetesConfig{
+		Resources:   []string{KubeSecrets, KubeConfigMaps},
+		KidTemplate: "{{.Name}}-{{.Key}}",
+		Timeout:     10 * time.Second,
+	}
+}
+
+// Enabled returns true if a label selector is configured
+func (c *KubernetesConfig) Enabled() bool {
+	return c.LabelSelector != ""
+}
+
+// Validate checks the config
+func (c *KubernetesConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	if len(c.Resources) == 0 {
+		return errors.New("k8s-resources must not be empty")
+	}
+
+	for _, r := range c.Resources {
+		if r != KubeSecrets && r != KubeConfigMaps {
+			return fmt.Errorf("k8s-resources: unknown resource %s, must be %s or %s", r, KubeSecrets, KubeConfigMaps)
+		}
+	}
+
+	for _, ns := range c.Namespaces {
+		if ns == "" {
+			return errors.New("k8s-namespace must not be empty")
+		}
+	}
+
+	if _, err := template.New("kid").Parse(c.KidTemplate); err != nil {
+		return fmt.Errorf("k8s-kid-template: %w", err)
+	}
+
+	if c.Timeout <= 0 {
+		return errors.New("k8s-timeout must be positive")
+	}
+
+	return nil
+}
+
+// kubeObject is a Secret or a ConfigMap, with the data of the ConfigMaps as bytes
+type kubeObject struct {
+	Namespace       string
+	Name            string
+	ResourceVersion string
+	Data            map[string][]byte
+}
+
+// kubeObjectOf converts a Secret or a ConfigMap, false for any other object
+func kubeObjectOf(obj interface{}) (kubeObject, bool) {
+	switch o := obj.(type) {
+	case *corev1.Secret:
+		return kubeObject{
+			Namespace:       o.Namespace,
+			Name:            o.Name,
+			ResourceVersion: o.ResourceVersion,
+			Data:            o.Data,
+		}, true
+
+	case *corev1.ConfigMap:
+		data := make(map[string][]byte, len(o.Data)+len(o.BinaryData))
+		for key, value := range o.Data {
+			data[key] = []byte(value)
+		}
+
+		for key, value := range o.BinaryData {
+			data[key] = value
+		}
+
+		return kubeObject{
+			Namespace:       o.Namespace,
+			Name:            o.Name,
+			ResourceVersion: o.ResourceVersion,
+			Data:            data,
+		}, true
+	}
+
+	return kubeObject{}, false
+}
+
+// kidFields are the fields available to the key id template
+type kidFields struct {
+	Namespace string
+	Kind      string
+	Name      string
+	Key       string
+}
+
+// Kubernetes loads the keys from the data entries of the Secrets and the ConfigMaps matching a label selector,
+// each data entry is a key, the objects are watched through the API, so new objects are loaded without a restart
+type Kubernetes struct {
+	config      KubernetesConfig
+	client      kubernetes.Interface
+	kidTemplate *template.Template
+
+	// the signature of every list made by the last fetch, by resource and namespace, protected by m
+	m     sync.Mutex
+	lists map[string]string
+}
+
+// NewKubernetes creates a Kubernetes API source, without an API server the in cluster config of the service account
+// is used, the namespace of the pod is used if no namespace is configured
+func NewKubernetes(config KubernetesConfig) (*Kubernetes, error) {
+	if config.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("not running in a cluster, provide the k8s-api-server")
+		}
+
+		config.APIServer = "https://" + net.JoinHostPort(host, port)
+
+		if config.TokenFile == "" {
+			config.TokenFile = serviceAccountToken
+		}
+
+		if config.CAFile == "" {
+			config.CAFile = serviceAccountCA
+		}
+	}
+
+	if len(config.Namespaces) == 0 {
+		ns, err := os.ReadFile(serviceAccountNamespace)
+		if err != nil {
+			return nil, fmt.Errorf("reading the namespace of the pod, provide the k8s-namespace: %w", err)
+		}
+
+		config.Namespaces = []string{strings.TrimSpace(string(ns))}
+	}
+
+	client, err := kubernetes.NewForConfig(&rest.Config{
+		Host:            config.APIServer,
+		BearerTokenFile: config.TokenFile,
+		TLSClientConfig: rest.TLSClientConfig{CAFile: config.CAFile},
+		UserAgent:       "go-jwks-server",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating the Kubernetes client: %w", err)
+	}
+
+	return newKubernetes(config, client)
+}
+
+func newKubernetes(config KubernetesConfig, client kubernetes.Interface) (*Kubernetes, error) {
+	kidTemplate, err := template.New("kid").Option("missingkey=error").Parse(config.KidTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the key id template: %w", err)
+	}
+
+	return &Kubernetes{
+		config:      config,
+		client:      client,
+		kidTemplate: kidTemplate,
+		lists:       map[string]string{},
+	}, nil
+}
+
+func (k *Kubernetes) Name() string {
+	return "k8s:" + strings.Join(k.config.Namespaces, ",") + "/" + k.config.LabelSelector
+}
+
+// Fetch lists the matching objects of every resource in every namespace
+func (k *Kubernetes) Fetch(ctx context.Context) (*Snapshot, error) {
+	snapshot := &Snapshot{
+		Skipped: map[string]string{},
+	}
+
+	lists := map[string]string{}
+
+	for _, ns := range k.config.Namespaces {
+		for _, resource := range k.config.Resources {
+			objects, err := k.list(ctx, resource, ns)
+			if err != nil {
+				return nil, fmt.Errorf("listing %s in namespace %s: %w", resource, ns, err)
+			}
+
+			lists[resource+"/"+ns] = kubeListSignature(objects)
+
+			for _, o := range objects {
+				if err := k.addObject(snapshot, resource, o); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	k.m.Lock()
+	k.lists = lists
+	k.m.Unlock()
+
+	return snapshot, nil
+}
+
+// list returns the objects of the resource in the namespace matching the selector
+func (k *Kubernetes) list(ctx context.Context, resource, namespace string) ([]kubeObject, error) {
+	ctx, cancel := context.WithTimeout(ctx, k.config.Timeout)
+	defer cancel()
+
+	options := metav1.ListOptions{LabelSelector: k.config.LabelSelector}
+
+	var items []interface{}
+
+	if resource == KubeSecrets {
+		list, err := k.client.CoreV1().Secrets(namespace).List(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range list.Items {
+			items = append(items, &list.Items[i])
+		}
+	} else {
+		list, err := k.client.CoreV1().ConfigMaps(namespace).List(ctx, options)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range list.Items {
+			items = append(items, &list.Items[i])
+		}
+	}
+
+	return kubeObjects(items), nil
+}
+
+// kubeObjects converts the Secrets and the ConfigMaps of a list or of an informer store
+func kubeObjects(items []interface{}) []kubeObject {
+	objects := make([]kubeObject, 0, len(items))
+	for _, item := range items {
+		if o, ok := kubeObjectOf(item); ok {
+			objects = append(objects, o)
+		}
+	}
+
+	return objects
+}
+
+// addObject adds every data entry of the object to the snapshot, in the order of the data keys
+func (k *Kubernetes) addObject(snapshot *Snapshot, resource string, o kubeObject) error {
+	keys := make([]string, 0, len(o.Data))
+	for key := range o.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	kind := "Secret"
+	if resource == KubeConfigMaps {
+		kind = "ConfigMap"
+	}
+
+	for _, key := range keys {
+		name := resource + "/" + o.Namespace + "/" + o.Name + "/" + key
+
+		if strings.HasSuffix(key, ".ignore") {
+			snapshot.Skipped[name] = "ignored key"
+			continue
+		}
+
+		var kid bytes.Buffer
+
+		err := k.kidTemplate.Execute(&kid, kidFields{
+			Namespace: o.Namespace,
+			Kind:      kind,
+			Name:      o.Name,
+			Key:       KidFromPath(key, "/"),
+		})
+		if err != nil {
+			return fmt.Errorf("executing the key id template for %s: %w", name, err)
+		}
+
+		snapshot.Keys = append(snapshot.Keys, KeyData{
+			Name: name,
+			Kid:  kid.String(),
+			Data: o.Data[key],
+		})
+	}
+
+	return nil
+}
+
+// Watch runs an informer on every resource in every namespace and calls changed on every event
+func (k *Kubernetes) Watch(ctx context.Context, changed func()) error {
+	eg, ctx := errgroup.WithContext(ctx)
+
+	for _, ns := range k.config.Namespaces {
+		ns := ns
+		eg.Go(func() error {
+			k.watchNamespace(ctx, ns, changed)
+			return nil
+		})
+	}
+
+	return eg.Wait()
+}
+
+// watchNamespace runs the informers of the namespace until the context is done, the informers list again
+// and retry on their own after a failure
+// once synced, changed is called if the objects differ from the ones of the last fetch,
+// so the events missed between the fetch and the start of the informers are not lost
+func (k *Kubernetes) watchNamespace(ctx context.Context, namespace string, changed func()) {
+	factory := informers.NewSharedInformerFactoryWithOptions(k.client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = k.config.LabelSelector
+		}),
+	)
+	defer factory.Shutdown()
+
+	handler := cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			// the initial list is compared to the last fetch once synced
+			if !isInInitialList {
+				changed()
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldObject, _ := kubeObjectOf(oldObj)
+			newObject, _ := kubeObjectOf(newObj)
+
+			if oldObject.ResourceVersion != newObject.ResourceVersion {
+				changed()
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			changed()
+		},
+	}
+
+	stores := map[string]cache.Store{}
+
+	for _, resource := range k.config.Resources {
+		var informer cache.SharedIndexInformer
+		if resource == KubeSecrets {
+			informer = factory.Core().V1().Secrets().Informer()
+		} else {
+			informer = factory.Core().V1().ConfigMaps().Informer()
+		}
+
+		logger := log.With().Str("resource", resource).Str("namespace", namespace).Logger()
+
+		if err := informer.SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
+			logger.Error().Err(err).Msg("watching failed")
+		}); err != nil {
+			logger.Error().Err(err).Msg("setting the watch error handler")
+		}
+
+		if _, err := informer.AddEventHandler(handler); err != nil {
+			logger.Error().Err(err).Msg("adding the event handler")
+			return
+		}
+
+		stores[resource] = informer.GetStore()
+	}
+
+	factory.Start(ctx.Done())
+
+	for _, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return
+		}
+	}
+
+	log.Debug().Str("namespace", namespace).Msg("watching")
+
+	for resource, store := range stores {
+		k.m.Lock()
+		fetched := k.lists[resource+"/"+namespace]
+		k.m.Unlock()
+
+		if kubeListSignature(kubeObjects(store.List())) != fetched {
+			changed()
+			break
+		}
+	}
+
+	<-ctx.Done()
+}
+
+// kubeListSignature identifies the listed objects, it changes if an object is added, removed or modified
+func kubeListSignature(objects []kubeObject) string {
+	lines := make([]string, 0, len(objects))
+	for _, o := range objects {
+		lines = append(lines, o.Namespace+"/"+o.Name+"@"+o.ResourceVersion)
+	}
+	sort.Strings(lines)
+
+	return strings.Join(lines, ",")
+}
+
+// sleepCtx waits for the duration or until the context is done
+func sleepCtx(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
@@ -0,0 +1,109 @@
+package keysource
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestKubernetesFetch(t *testing.T) {
+	labels := map[string]string{"jwks": "public"}
+
+	client := fake.NewSimpleClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns1", Name: "signer", Labels: labels},
+			Data: map[string][]byte{
+				"key1.pub":   []byte("key1"),
+				"key2":       []byte("key2"),
+				"old.ignore": []byte("old"),
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns1", Name: "other", Labels: map[string]string{"jwks": "private"}},
+			Data:       map[string][]byte{"key1": []byte("private")},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns2", Name: "partner", Labels: labels},
+			Data:       map[string]string{"key1": "partner-key1"},
+			BinaryData: map[string][]byte{"key2": []byte("partner-key2")},
+		},
+	)
+
+	config := NewKubernetesConfig()
+	config.LabelSelector = "jwks=public"
+	config.Namespaces = []string{"ns1", "ns2"}
+	config.KidTemplate = "{{.Namespace}}.{{.Name}}.{{.Key}}"
+
+	k, err := newKubernetes(config, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := k.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	kids := map[string]string{}
+	for _, kd := range snapshot.Keys {
+		kids[kd.Kid] = string(kd.Data)
+	}
+
+	wantKids := map[string]string{
+		"ns1.signer.key1":  "key1",
+		"ns1.signer.key2":  "key2",
+		"ns2.partner.key1": "partner-key1",
+		"ns2.partner.key2": "partner-key2",
+	}
+	if !reflect.DeepEqual(kids, wantKids) {
+		t.Errorf("keys = %v, want %v", kids, wantKids)
+	}
+
+	if _, ok := snapshot.Skipped["secrets/ns1/signer/old.ignore"]; !ok {
+		t.Errorf("the ignored key was not skipped: %v", snapshot.Skipped)
+	}
+
+	// a new Secret is noticed by the watch
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	changed := make(chan struct{}, 10)
+	go k.Watch(ctx, func() { changed <- struct{}{} }) // nolint:errcheck
+
+	// the informers are synced once the unchanged objects are compared to the fetch
+	time.Sleep(100 * time.Millisecond)
+
+	select {
+	case <-changed:
+		t.Fatal("the objects of the fetch were reported as changed")
+	default:
+	}
+
+	_, err = client.CoreV1().Secrets("ns1").Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns1", Name: "new-signer", Labels: labels},
+		Data:       map[string][]byte{"key1": []byte("new")},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+	case <-ctx.Done():
+		t.Fatal("the new Secret was not noticed")
+	}
+
+	snapshot, err = k.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch after the change:", err)
+	}
+
+	if len(snapshot.Keys) != 5 {
+		t.Errorf("the keys of the new Secret were not loaded: %+v", snapshot.Keys)
+	}
+}
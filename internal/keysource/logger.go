@@ -0,0 +1,10 @@
+package keysource
+
+import "github.com/rs/zerolog"
+
+// no logging by default
+var log zerolog.Logger
+
+func SetLogger(logger zerolog.Logger) {
+	log = logger
+}
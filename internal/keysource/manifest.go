@@ -0,0 +1,279 @@
+package keysource
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Manifest loads the keys listed in a YAML or JSON manifest file, with their metadata, for example:
+//
+//	keys:
+//	  - kid: signer-2024
+//	    file: keys/signer-2024.pub
+//	    alg: PS256
+//	    nbf: 2024-01-01T00:00:00Z
+//	    exp: 2025-01-01T00:00:00Z
+//	    labels:
+//	      team: payments
+//	    aliases:
+//	      - kid: signer-old-scheme
+//	        exp: 2024-07-01T00:00:00Z
+//	  - kid: legacy
+//	    pem: |
+//	      -----BEGIN PUBLIC KEY-----
+//	      ...
+//
+// the whole manifest is validated before any key is returned, an invalid entry fails the load
+// the kid of an entry is authoritative, a key material with another key id is rejected by the keyloader
+type Manifest struct {
+	path     string
+	interval time.Duration
+
+	m sync.Mutex
+	// the files referenced by the manifest at the last fetch, watched with the manifest
+	files []string
+}
+
+// manifestFile is the content of a manifest
+type manifestFile struct {
+	Keys []manifestEntry `json:"keys" yaml:"keys"`
+}
+
+// manifestEntry is a key of a manifest
+type manifestEntry struct {
+	// the key id of the key, a key id in the material (a JWK kid or a Kid PEM header) must be the same
+	Kid string `json:"kid" yaml:"kid"`
+
+	// the key material, a file relative to the manifest or inline, exactly one of them
+	File string `json:"file" yaml:"file"`
+	PEM  string `json:"pem" yaml:"pem"`
+
+	Alg string `json:"alg" yaml:"alg"`
+	Use string `json:"use" yaml:"use"`
+
+	// RFC 3339 timestamps or unix seconds
+	NotBefore manifestTime `json:"nbf" yaml:"nbf"`
+	Expires   manifestTime `json:"exp" yaml:"exp"`
+
+	Labels map[string]string `json:"labels" yaml:"labels"`
+
+	Aliases []manifestAlias `json:"aliases" yaml:"aliases"`
+}
+
+// manifestAlias is another key id of a key of a manifest, see Alias
+type manifestAlias struct {
+	Kid     string       `json:"kid" yaml:"kid"`
+	Expires manifestTime `json:"exp" yaml:"exp"`
+}
+
+// NewManifest creates a manifest source, the manifest and the files it references are polled for changes every interval,
+// 0 disables watching
+func NewManifest(path string, interval time.Duration) *Manifest {
+	return &Manifest{
+		path:     path,
+		interval: interval,
+	}
+}
+
+func (m *Manifest) Name() string {
+	return "manifest:" + m.path
+}
+
+// Fetch reads and validates the manifest and the key files, Snapshot.Version is a hash of all of them
+// the modification time of a key is the one of its file, or of the manifest for the inline keys
+func (m *Manifest) Fetch(ctx context.Context) (*Snapshot, error) {
+	data, info, err := ReadFile(m.path, maxArchiveSize)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+
+	manifest, err := parseManifest(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing manifest %s: %w", m.path, err)
+	}
+
+	snapshot := &Snapshot{
+		Keys: make([]KeyData, 0, len(manifest.Keys)),
+	}
+
+	var files []string
+	hashed := [][]byte{data}
+
+	for _, e := range manifest.Keys {
+		kd := KeyData{
+			Name:      e.Kid,
+			Kid:       e.Kid,
+			KidStrict: true,
+			Data:      []byte(e.PEM),
+			ModTime:   info.ModTime(),
+			Alg:       e.Alg,
+			Use:       e.Use,
+			NotBefore: e.NotBefore.Time,
+			Expires:   e.Expires.Time,
+			Labels:    e.Labels,
+		}
+
+		for _, a := range e.Aliases {
+			kd.Aliases = append(kd.Aliases, Alias{Kid: a.Kid, Expires: a.Expires.Time})
+		}
+
+		if e.File != "" {
+			path := e.File
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(filepath.Dir(m.path), path)
+			}
+
+			files = append(files, path)
+
+			data, fileInfo, err := ReadFile(path, maxArchiveSize)
+			if err != nil {
+				return nil, fmt.Errorf("key %s: reading key file: %w", e.Kid, err)
+			}
+
+			kd.Data = data
+
+			kd.ModTime = fileInfo.ModTime()
+		}
+
+		hashed = append(hashed, kd.Data)
+		snapshot.Keys = append(snapshot.Keys, kd)
+	}
+
+	snapshot.Version = sha256Hex(bytes.Join(hashed, []byte{0}))[:16]
+
+	m.m.Lock()
+	m.files = files
+	m.m.Unlock()
+
+	return snapshot, nil
+}
+
+// Watch polls the size and the modification time of the manifest and of the key files it referenced at the last fetch
+func (m *Manifest) Watch(ctx context.Context, changed func()) error {
+	paths := func() []string {
+		m.m.Lock()
+		defer m.m.Unlock()
+
+		return append([]string{m.path}, m.files...)
+	}
+
+	return pollFiles(ctx, paths, m.interval, changed, "key manifest changed")
+}
+
+// parseManifest decodes a JSON or YAML manifest and validates it, the unknown fields are errors
+func parseManifest(data []byte) (*manifestFile, error) {
+	var manifest manifestFile
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+
+		if err := decoder.Decode(&manifest); err != nil {
+			return nil, err
+		}
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+
+		// an empty document has no keys
+		if err := decoder.Decode(&manifest); err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+	}
+
+	seen := map[string]bool{}
+
+	for i, e := range manifest.Keys {
+		if e.Kid == "" {
+			return nil, fmt.Errorf("key %d: kid is required", i+1)
+		}
+
+		if seen[e.Kid] {
+			return nil, fmt.Errorf("key %s: kid is listed more than once", e.Kid)
+		}
+
+		seen[e.Kid] = true
+
+		if err := e.validate(); err != nil {
+			return nil, fmt.Errorf("key %s: %w", e.Kid, err)
+		}
+	}
+
+	// the aliases must not shadow a key or another alias
+	for _, e := range manifest.Keys {
+		for _, a := range e.Aliases {
+			if a.Kid == "" {
+				return nil, fmt.Errorf("key %s: alias kid is required", e.Kid)
+			}
+
+			if seen[a.Kid] {
+				return nil, fmt.Errorf("key %s: alias %s is already a kid or an alias", e.Kid, a.Kid)
+			}
+
+			seen[a.Kid] = true
+		}
+	}
+
+	return &manifest, nil
+}
+
+// validate checks the fields of an entry, except the key material that is parsed by the keyloader
+func (e *manifestEntry) validate() error {
+	if (e.File == "") == (e.PEM == "") {
+		return errors.New("exactly one of file and pem is required")
+	}
+
+	if err := ValidateAlgUse(e.Alg, e.Use); err != nil {
+		return err
+	}
+
+	if !e.NotBefore.IsZero() && !e.Expires.IsZero() && !e.Expires.After(e.NotBefore.Time) {
+		return errors.New("exp must be after nbf")
+	}
+
+	for name := range e.Labels {
+		if strings.TrimSpace(name) == "" {
+			return errors.New("label names must not be empty")
+		}
+	}
+
+	return nil
+}
+
+// manifestTime is a timestamp of a manifest, an RFC 3339 string or unix seconds
+type manifestTime struct {
+	time.Time
+}
+
+func (t *manifestTime) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	return t.parse(strings.Trim(string(data), `"`))
+}
+
+func (t *manifestTime) UnmarshalYAML(node *yaml.Node) error {
+	return t.parse(node.Value)
+}
+
+func (t *manifestTime) parse(value string) error {
+	parsed, err := ParseTimestamp(value)
+	if err != nil {
+		return err
+	}
+
+	t.Time = parsed
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package keysource
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.MkdirAll(filepath.Join(dir, "keys"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "keys", "signer.pub"), []byte("material1"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "manifest.yaml")
+	manifest := `
+keys:
+  - kid: signer-2024
+    file: keys/signer.pub
+    alg: PS256
+    use: sig
+    nbf: 2024-01-01T00:00:00Z
+    exp: 1735689600
+    labels:
+      team: payments
+    aliases:
+      - kid: signer-old
+        exp: 2024-07-01T00:00:00Z
+  - kid: legacy
+    pem: |
+      material2
+`
+	if err := os.WriteFile(path, []byte(manifest), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewManifest(path, 10*time.Millisecond)
+
+	snapshot, err := m.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	if want := []string{"signer-2024=material1", "legacy=material2\n"}; !reflect.DeepEqual(snapshotNames(snapshot), want) {
+		t.Errorf("keys = %q, want %q", snapshotNames(snapshot), want)
+	}
+
+	signer := snapshot.Keys[0]
+	if !signer.KidStrict {
+		t.Errorf("the kid of a manifest entry must be strict")
+	}
+
+	if signer.Alg != "PS256" || signer.Use != "sig" || !reflect.DeepEqual(signer.Labels, map[string]string{"team": "payments"}) {
+		t.Errorf("signer metadata: alg %s, use %s, labels %v", signer.Alg, signer.Use, signer.Labels)
+	}
+
+	if want := []Alias{{Kid: "signer-old", Expires: time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)}}; !reflect.DeepEqual(signer.Aliases, want) {
+		t.Errorf("aliases = %v, want %v", signer.Aliases, want)
+	}
+
+	if !signer.NotBefore.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) || !signer.Expires.Equal(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("signer window: nbf %s, exp %s", signer.NotBefore, signer.Expires)
+	}
+
+	// a change of a referenced key file is noticed
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	go m.Watch(ctx, func() { // nolint:errcheck
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	// let the watch see the first version of the files
+	time.Sleep(50 * time.Millisecond)
+
+	replaceFile(t, filepath.Join(dir, "keys", "signer.pub"), []byte("material1 rotated"))
+
+	select {
+	case <-changed:
+	case <-ctx.Done():
+		t.Fatal("the changed key file was not noticed")
+	}
+
+	// the same manifest in JSON
+	replaceFile(t, path, []byte(`{"keys": [{"kid": "signer-2024", "file": "keys/signer.pub", "exp": "2025-01-01T00:00:00Z"}]}`))
+
+	snapshot, err = m.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	if want := []string{"signer-2024=material1 rotated"}; !reflect.DeepEqual(snapshotNames(snapshot), want) {
+		t.Errorf("keys = %q, want %q", snapshotNames(snapshot), want)
+	}
+}
+
+func TestManifestValidation(t *testing.T) {
+	tests := []struct {
+		manifest string
+		want     string
+	}{
+		{"keys:\n  - file: a.pub\n", "key 1: kid is required"},
+		{"keys:\n  - kid: a\n    pem: x\n  - kid: a\n    pem: y\n", "key a: kid is listed more than once"},
+		{"keys:\n  - kid: a\n", "key a: exactly one of file and pem is required"},
+		{"keys:\n  - kid: a\n    file: a.pub\n    pem: x\n", "key a: exactly one of file and pem is required"},
+		{"keys:\n  - kid: a\n    pem: x\n    use: sign\n", "key a: use sign must be sig or enc"},
+		{"keys:\n  - kid: a\n    pem: x\n    alg: XS256\n", "key a: unknown alg XS256"},
+		{"keys:\n  - kid: a\n    pem: x\n    nbf: 2025-01-01T00:00:00Z\n    exp: 2024-01-01T00:00:00Z\n", "key a: exp must be after nbf"},
+		{"keys:\n  - kid: a\n    pem: x\n    exp: tomorrow\n", "timestamp tomorrow must be RFC 3339 or unix seconds"},
+		{"keys:\n  - kid: a\n    pem: x\n    algorithm: RS256\n", "field algorithm not found"},
+		{`{"keys": [{"kid": "a", "pem": "x", "labels": {"": "b"}}]}`, "key a: label names must not be empty"},
+		{`{"keys": [{"kid": "a", "pem": "x", "algorithm": "RS256"}]}`, `unknown field "algorithm"`},
+		{"keys:\n  - kid: a\n    pem: x\n    aliases:\n      - exp: 1735689600\n", "key a: alias kid is required"},
+		{"keys:\n  - kid: a\n    pem: x\n    aliases:\n      - kid: b\n  - kid: b\n    pem: y\n", "key a: alias b is already a kid or an alias"},
+	}
+
+	for _, tt := range tests {
+		_, err := parseManifest([]byte(tt.manifest))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseManifest(%q) = %v, want %q", tt.manifest, err, tt.want)
+		}
+	}
+
+	// an encryption key with a key encryption alg is valid
+	if _, err := parseManifest([]byte("keys:\n  - kid: a\n    pem: x\n    alg: RSA-OAEP\n    use: enc\n")); err != nil {
+		t.Errorf("parseManifest: %v", err)
+	}
+}
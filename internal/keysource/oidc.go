@@ -0,0 +1,218 @@
+package keysource
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// the path of the OpenID Connect discovery document, relative to the issuer
+const oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+// OIDCConfig configures an OpenID Connect issuer source
+type OIDCConfig struct {
+	// controls how the discovery document and the keys are fetched
+	Remote RemoteConfig
+
+	// how often the discovery document is resolved again, independently of the refresh of the keys,
+	// 0 resolves it on every fetch of the keys only
+	DiscoveryInterval time.Duration
+
+	// optional prefix of the key ids of the issuer, to avoid the conflicts with the keys of other issuers
+	KidPrefix string
+}
+
+// OIDC loads the keys of an OpenID Connect issuer, the jwks_uri is taken from the discovery document of the issuer
+type OIDC struct {
+	issuer string
+	config OIDCConfig
+	client *http.Client
+
+	// fetches the keys from the jwks_uri
+	jwks *Remote
+
+	// the jwks_uri and when it was resolved, protected by m
+	m            sync.Mutex
+	jwksURI      string
+	resolvedTime time.Time
+}
+
+// NewOIDC creates an issuer source, the client is usually created with NewHTTPClient
+func NewOIDC(issuer string, config OIDCConfig, client *http.Client) *OIDC {
+	return &OIDC{
+		issuer: issuer,
+		config: config,
+		client: client,
+		jwks:   NewRemote("", config.Remote, client),
+	}
+}
+
+func (o *OIDC) Name() string {
+	return "oidc:" + o.issuer
+}
+
+// Fetch resolves the discovery document if it is due, then fetches the keys from the jwks_uri
+// if the discovery fails the previous jwks_uri is used
+func (o *OIDC) Fetch(ctx context.Context) (*Snapshot, error) {
+	if err := o.resolve(ctx, false); err != nil {
+		o.jwks.retryLater()
+		return nil, err
+	}
+
+	snapshot, err := o.jwks.Fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range snapshot.Keys {
+		snapshot.Keys[i].KidPrefix = o.config.KidPrefix
+	}
+
+	return snapshot, nil
+}
+
+// resolve fetches the discovery document and updates the jwks_uri, if it was not resolved
+// in the last DiscoveryInterval or if force is set
+func (o *OIDC) resolve(ctx context.Context, force bool) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if !force && o.jwksURI != "" && time.Since(o.resolvedTime) < o.config.DiscoveryInterval {
+		return nil
+	}
+
+	jwksURI, err := o.discover(ctx)
+	if err != nil {
+		if o.jwksURI == "" {
+			return fmt.Errorf("resolving the discovery document: %w", err)
+		}
+
+		log.Warn().Err(err).Str("issuer", o.issuer).Str("jwksUri", o.jwksURI).
+			Msg("resolving the discovery document failed, using the previous jwks_uri")
+		return nil
+	}
+
+	if jwksURI != o.jwksURI {
+		log.Info().Str("issuer", o.issuer).Str("jwksUri", jwksURI).Msg("resolved jwks_uri")
+	}
+
+	o.jwksURI = jwksURI
+	o.resolvedTime = time.Now()
+	o.jwks.setURL(jwksURI)
+
+	return nil
+}
+
+// discover fetches the discovery document, checks the issuer and returns the jwks_uri
+func (o *OIDC) discover(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(o.issuer, "/")+oidcDiscoveryPath, nil)
+	if err != nil {
+		return "", fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "go-jwks-server")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetching discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("discovery document answered with status %s", resp.Status)
+	}
+
+	var doc struct {
+		Issuer  string `json:"issuer"`
+		JwksURI string `json:"jwks_uri"`
+	}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRemoteBodySize)).Decode(&doc); err != nil {
+		return "", fmt.Errorf("decoding discovery document: %w", err)
+	}
+
+	// the issuer must match exactly, a trailing slash in the configuration is tolerated
+	if doc.Issuer != o.issuer && doc.Issuer != strings.TrimSuffix(o.issuer, "/") {
+		return "", fmt.Errorf("discovery document issuer %q does not match %q", doc.Issuer, o.issuer)
+	}
+
+	if doc.JwksURI == "" {
+		return "", errors.New("discovery document has no jwks_uri")
+	}
+
+	jwksURI, err := url.Parse(doc.JwksURI)
+	if err != nil || !jwksURI.IsAbs() || jwksURI.Host == "" {
+		return "", fmt.Errorf("discovery document jwks_uri %q is not an absolute url", doc.JwksURI)
+	}
+
+	// a plain http jwks_uri is accepted only from a plain http issuer
+	if jwksURI.Scheme != "https" && !(jwksURI.Scheme == "http" && strings.HasPrefix(o.issuer, "http://")) {
+		return "", fmt.Errorf("discovery document jwks_uri %q must use https", doc.JwksURI)
+	}
+
+	return doc.JwksURI, nil
+}
+
+// Watch calls changed every time the keys need to be fetched again, see Remote.Watch,
+// and when the jwks_uri of the discovery document, resolved every DiscoveryInterval, changes
+func (o *OIDC) Watch(ctx context.Context, changed func()) error {
+	if o.config.DiscoveryInterval <= 0 {
+		return o.jwks.Watch(ctx, changed)
+	}
+
+	eg, ctx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		return o.jwks.Watch(ctx, changed)
+	})
+
+	eg.Go(func() error {
+		o.watchDiscovery(ctx, changed)
+		return nil
+	})
+
+	return eg.Wait()
+}
+
+// watchDiscovery resolves the discovery document every DiscoveryInterval and calls changed if the jwks_uri changed,
+// so a new jwks_uri is followed even if the keys are not refreshed
+func (o *OIDC) watchDiscovery(ctx context.Context, changed func()) {
+	ticker := time.NewTicker(o.config.DiscoveryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+		}
+
+		o.m.Lock()
+		previous := o.jwksURI
+		o.m.Unlock()
+
+		if err := o.resolve(ctx, true); err != nil {
+			log.Error().Err(err).Str("issuer", o.issuer).Msg("resolving the discovery document failed")
+			continue
+		}
+
+		o.m.Lock()
+		current := o.jwksURI
+		o.m.Unlock()
+
+		if current != previous {
+			changed()
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package keysource
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestOIDCFetch(t *testing.T) {
+	var issuer atomic.Value
+	var jwksPath atomic.Value
+	var discoveryDown int32
+
+	jwksPath.Store("/jwks1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&discoveryDown) == 1 {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{ // nolint:errcheck
+			"issuer":   issuer.Load().(string),
+			"jwks_uri": "http://" + r.Host + jwksPath.Load().(string),
+		})
+	})
+	mux.HandleFunc("/jwks1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testJWKS)) // nolint:errcheck
+	})
+	mux.HandleFunc("/jwks2", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys":[{"kty":"oct","kid":"upstream2","k":"c2VjcmV0"}]}`)) // nolint:errcheck
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	issuer.Store(srv.URL)
+
+	config := OIDCConfig{
+		Remote:            testRemoteConfig(),
+		DiscoveryInterval: time.Hour,
+		KidPrefix:         "partner:",
+	}
+
+	o := NewOIDC(srv.URL+"/", config, srv.Client())
+
+	fetch := func() *Snapshot {
+		t.Helper()
+
+		snapshot, err := o.Fetch(context.Background())
+		if err != nil {
+			t.Fatal("fetch:", err)
+		}
+
+		if len(snapshot.Keys) != 1 || snapshot.Keys[0].KidPrefix != "partner:" {
+			t.Fatalf("unexpected snapshot %+v", snapshot)
+		}
+
+		return snapshot
+	}
+
+	if snapshot := fetch(); string(snapshot.Keys[0].Data) != testJWKS {
+		t.Errorf("the keys of the first jwks_uri were not fetched")
+	}
+
+	// the jwks_uri changed, it is not resolved again before the discovery interval
+	jwksPath.Store("/jwks2")
+
+	if snapshot := fetch(); string(snapshot.Keys[0].Data) != testJWKS {
+		t.Errorf("the discovery document was resolved before the discovery interval")
+	}
+
+	o.resolvedTime = time.Now().Add(-2 * time.Hour)
+
+	if snapshot := fetch(); snapshot.Keys[0].Name != srv.URL+"/jwks2" {
+		t.Errorf("the new jwks_uri was not followed: %s", snapshot.Keys[0].Name)
+	}
+
+	// the discovery fails, the previous jwks_uri is used
+	atomic.StoreInt32(&discoveryDown, 1)
+	o.resolvedTime = time.Now().Add(-2 * time.Hour)
+
+	if snapshot := fetch(); snapshot.Keys[0].Name != srv.URL+"/jwks2" {
+		t.Errorf("the previous jwks_uri was not used: %s", snapshot.Keys[0].Name)
+	}
+
+	// the issuer does not match
+	atomic.StoreInt32(&discoveryDown, 0)
+	issuer.Store("https://other.example.com")
+
+	o = NewOIDC(srv.URL, config, srv.Client())
+
+	if _, err := o.Fetch(context.Background()); err == nil {
+		t.Errorf("fetch with a wrong issuer in the discovery document must fail")
+	}
+}
+
+func TestOIDCWatchDiscovery(t *testing.T) {
+	var jwksPath atomic.Value
+	jwksPath.Store("/jwks1")
+
+	var srv *httptest.Server
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{ // nolint:errcheck
+			"issuer":   srv.URL,
+			"jwks_uri": srv.URL + jwksPath.Load().(string),
+		})
+	})
+	mux.HandleFunc("/jwks1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testJWKS)) // nolint:errcheck
+	})
+	mux.HandleFunc("/jwks2", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"keys":[{"kty":"oct","kid":"upstream2","k":"c2VjcmV0"}]}`)) // nolint:errcheck
+	})
+
+	srv = httptest.NewServer(mux)
+	defer srv.Close()
+
+	// the keys are never refreshed, only the discovery notices the new jwks_uri
+	remote := testRemoteConfig()
+	remote.RefreshInterval = 0
+
+	o := NewOIDC(srv.URL, OIDCConfig{Remote: remote, DiscoveryInterval: 20 * time.Millisecond}, srv.Client())
+
+	if _, err := o.Fetch(context.Background()); err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	go o.Watch(ctx, func() { // nolint:errcheck
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	jwksPath.Store("/jwks2")
+
+	select {
+	case <-changed:
+	case <-ctx.Done():
+		t.Fatal("the new jwks_uri was not noticed")
+	}
+
+	snapshot, err := o.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	if snapshot.Keys[0].Name != srv.URL+"/jwks2" {
+		t.Errorf("the new jwks_uri was not followed: %s", snapshot.Keys[0].Name)
+	}
+}
@@ -0,0 +1,351 @@
+package keysource
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+// the maximum size of an upstream JWKS response
+const maxRemoteBodySize = 4 * 1024 * 1024
+
+// RemoteConfig configures the remote JWKS sources
+type RemoteConfig struct {
+	// the timeout of a fetch, including reading the body
+	Timeout time.Duration
+
+	// optional PEM bundle of the CAs trusted for the upstreams, the system pool is used if empty
+	CAFile string
+
+	// the refresh interval when the upstream does not send a max-age, 0 disables refreshing
+	RefreshInterval time.Duration
+
+	// the bounds of the refresh interval derived from the Cache-Control max-age of the upstream
+	MinRefreshInterval time.Duration
+	MaxRefreshInterval time.Duration
+
+	// how long the last good response is served while the upstream fails, 0 disables the fallback
+	MaxStale time.Duration
+}
+
+// Validate checks the config, it does not read the CA file
+func (c *RemoteConfig) Validate() error {
+	if c.Timeout <= 0 {
+		return errors.New("remote-jwks-timeout must be positive")
+	}
+
+	if c.RefreshInterval < 0 || c.MinRefreshInterval < 0 || c.MaxRefreshInterval < 0 {
+		return errors.New("remote-jwks refresh intervals must not be negative")
+	}
+
+	if c.MaxRefreshInterval < c.MinRefreshInterval {
+		return errors.New("remote-jwks-max-refresh-interval must not be less than remote-jwks-min-refresh-interval")
+	}
+
+	if c.MaxStale < 0 {
+		return errors.New("remote-jwks-max-stale must not be negative")
+	}
+
+	return nil
+}
+
+// NewHTTPClient creates the http client shared by the remote sources
+func NewHTTPClient(config RemoteConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", config.CAFile)
+		}
+
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs:    pool,
+			MinVersion: tls.VersionTLS12,
+		}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   config.Timeout,
+	}, nil
+}
+
+// Remote loads the keys from an upstream JWKS URL
+// the upstream is fetched again when its Cache-Control max-age expires, conditional requests
+// are made with the ETag of the last good response
+type Remote struct {
+	url    string
+	config RemoteConfig
+	client *http.Client
+
+	// the last good response and when it was fetched or revalidated, protected by m
+	m        sync.Mutex
+	body     []byte
+	etag     string
+	modTime  time.Time
+	goodTime time.Time
+	maxAge   time.Duration
+	hasAge   bool
+
+	// the delay to the next refresh, sent by Fetch to the Watch loop
+	refresh chan time.Duration
+}
+
+// NewRemote creates a remote source for the url, the client is usually created with NewHTTPClient
+func NewRemote(url string, config RemoteConfig, client *http.Client) *Remote {
+	return &Remote{
+		url:     url,
+		config:  config,
+		client:  client,
+		refresh: make(chan time.Duration, 1),
+	}
+}
+
+func (r *Remote) Name() string {
+	return "remote:" + r.url
+}
+
+// setURL changes the url of the upstream, the last good response is kept as the fallback
+// but it is not revalidated with its ETag against the new url
+func (r *Remote) setURL(url string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if url != r.url {
+		r.url = url
+		r.etag = ""
+	}
+}
+
+// Fetch fetches the upstream JWKS, on failure the last good response is returned
+// if it is not older than MaxStale
+func (r *Remote) Fetch(ctx context.Context) (*Snapshot, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	err := r.fetch(ctx)
+
+	r.schedule(r.nextRefresh(err != nil))
+
+	if err != nil {
+		if r.body == nil || r.config.MaxStale <= 0 {
+			return nil, err
+		}
+
+		age := time.Since(r.goodTime)
+		if age > r.config.MaxStale {
+			return nil, fmt.Errorf("%w, the last good response expired %s ago", err, (age - r.config.MaxStale).Round(time.Second))
+		}
+
+		log.Warn().Err(err).Str("url", r.url).Dur("age", age).Msg("upstream failed, serving the last good response")
+	}
+
+	snapshot := &Snapshot{
+		Keys: []KeyData{{
+			Name:    r.url,
+			Data:    r.body,
+			ModTime: r.modTime,
+		}},
+		Version: r.etag,
+	}
+
+	return snapshot, nil
+}
+
+// fetch makes a conditional request and updates the last good response, the caller must hold m
+func (r *Remote) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/jwk-set+json, application/json")
+	req.Header.Set("User-Agent", "go-jwks-server")
+
+	if r.etag != "" && r.body != nil {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching upstream: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteBodySize+1))
+		if err != nil {
+			return fmt.Errorf("reading upstream response: %w", err)
+		}
+
+		if len(body) > maxRemoteBodySize {
+			return fmt.Errorf("upstream response larger than %d bytes", maxRemoteBodySize)
+		}
+
+		// parsed before replacing the last good response, a broken JWKS must not wipe out the MaxStale fallback
+		if _, err := jwk.Parse(body); err != nil {
+			return fmt.Errorf("parsing upstream response: %w", err)
+		}
+
+		r.body = body
+		r.etag = resp.Header.Get("ETag")
+		r.modTime = time.Now()
+
+		if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+			r.modTime = t
+		}
+
+	case http.StatusNotModified:
+		if r.body == nil {
+			return errors.New("upstream answered not modified to an unconditional request")
+		}
+
+		log.Debug().Str("url", r.url).Msg("upstream keys not modified")
+
+	default:
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxRemoteBodySize)) // nolint:errcheck
+		return fmt.Errorf("upstream answered with status %s", resp.Status)
+	}
+
+	r.goodTime = time.Now()
+	r.maxAge, r.hasAge = maxAge(resp.Header)
+
+	return nil
+}
+
+// retryLater schedules the next fetch as if the last one failed
+func (r *Remote) retryLater() {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.schedule(r.nextRefresh(true))
+}
+
+// schedule sends the delay to the next fetch to the Watch loop, the caller must hold m
+func (r *Remote) schedule(delay time.Duration) {
+	select {
+	case <-r.refresh: // only the latest delay matters
+	default:
+	}
+
+	r.refresh <- delay
+}
+
+// nextRefresh returns the delay to the next fetch, the caller must hold m
+func (r *Remote) nextRefresh(failed bool) time.Duration {
+	if r.config.RefreshInterval <= 0 {
+		return 0
+	}
+
+	// retry soon, the upstream is probably back before the refresh interval expires
+	if failed {
+		if r.config.MinRefreshInterval > 0 {
+			return r.config.MinRefreshInterval
+		}
+
+		return r.config.RefreshInterval
+	}
+
+	if !r.hasAge {
+		return r.config.RefreshInterval
+	}
+
+	delay := r.maxAge
+	if delay < r.config.MinRefreshInterval {
+		delay = r.config.MinRefreshInterval
+	}
+
+	if r.config.MaxRefreshInterval > 0 && delay > r.config.MaxRefreshInterval {
+		delay = r.config.MaxRefreshInterval
+	}
+
+	return delay
+}
+
+// Watch calls changed every time the upstream needs to be fetched again,
+// the delay is set by the last Fetch
+func (r *Remote) Watch(ctx context.Context, changed func()) error {
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case delay := <-r.refresh:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+
+			if delay > 0 {
+				timer.Reset(delay)
+			}
+
+		case <-timer.C:
+			changed()
+		}
+	}
+}
+
+// maxAge returns how long the response may be cached according to its Cache-Control and Age headers,
+// false if the response does not say
+func maxAge(header http.Header) (time.Duration, bool) {
+	var age time.Duration
+	var found bool
+
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0, true
+
+		case "max-age":
+			seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil || seconds < 0 {
+				continue
+			}
+
+			age = time.Duration(seconds) * time.Second
+			found = true
+		}
+	}
+
+	if !found {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(header.Get("Age")); err == nil && seconds > 0 {
+		age -= time.Duration(seconds) * time.Second
+		if age < 0 {
+			age = 0
+		}
+	}
+
+	return age, true
+}
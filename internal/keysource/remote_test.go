@@ -0,0 +1,196 @@
+package keysource
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testJWKS = `{"keys":[{"kty":"oct","kid":"upstream1","k":"c2VjcmV0"}]}`
+
+func testRemoteConfig() RemoteConfig {
+	return RemoteConfig{
+		Timeout:            5 * time.Second,
+		RefreshInterval:    5 * time.Minute,
+		MinRefreshInterval: 10 * time.Second,
+		MaxRefreshInterval: 1 * time.Hour,
+		MaxStale:           1 * time.Hour,
+	}
+}
+
+func TestRemoteFetch(t *testing.T) {
+	var failing int32
+	var broken int32
+	var notModified int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+
+		if atomic.LoadInt32(&broken) == 1 {
+			w.Header().Set("ETag", `"broken"`)
+			w.Write([]byte(`{"keys":[`)) // nolint:errcheck
+			return
+		}
+
+		w.Header().Set("Cache-Control", "public, max-age=60")
+
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(testJWKS)) // nolint:errcheck
+	}))
+	defer srv.Close()
+
+	config := testRemoteConfig()
+	r := NewRemote(srv.URL, config, srv.Client())
+
+	for i := 0; i < 2; i++ {
+		snapshot, err := r.Fetch(context.Background())
+		if err != nil {
+			t.Fatalf("fetch %d: %v", i, err)
+		}
+
+		if len(snapshot.Keys) != 1 || string(snapshot.Keys[0].Data) != testJWKS {
+			t.Fatalf("fetch %d: unexpected snapshot %+v", i, snapshot)
+		}
+
+		if snapshot.Version != `"v1"` {
+			t.Errorf("fetch %d: version = %s, want the ETag", i, snapshot.Version)
+		}
+
+		if delay := <-r.refresh; delay != 60*time.Second {
+			t.Errorf("fetch %d: refresh delay = %s, want the max-age", i, delay)
+		}
+	}
+
+	if atomic.LoadInt32(&notModified) != 1 {
+		t.Errorf("the second fetch was not a conditional request")
+	}
+
+	// the upstream answers a broken JWKS, the last good response is kept and served
+	atomic.StoreInt32(&broken, 1)
+
+	snapshot, err := r.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch of a broken response:", err)
+	}
+
+	if string(snapshot.Keys[0].Data) != testJWKS || snapshot.Version != `"v1"` {
+		t.Errorf("the broken response replaced the last good one: %+v", snapshot)
+	}
+
+	<-r.refresh
+
+	// the upstream is down, the last good response is served
+	atomic.StoreInt32(&broken, 0)
+	atomic.StoreInt32(&failing, 1)
+
+	snapshot, err = r.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch with the upstream down:", err)
+	}
+
+	if string(snapshot.Keys[0].Data) != testJWKS {
+		t.Errorf("the last good response was not served")
+	}
+
+	if delay := <-r.refresh; delay != config.MinRefreshInterval {
+		t.Errorf("retry delay = %s, want %s", delay, config.MinRefreshInterval)
+	}
+
+	// the last good response expired
+	r.goodTime = time.Now().Add(-2 * config.MaxStale)
+
+	if _, err := r.Fetch(context.Background()); err == nil {
+		t.Errorf("fetch with an expired last good response must fail")
+	}
+
+	// no fallback
+	r.config.MaxStale = 0
+	r.goodTime = time.Now()
+
+	if _, err := r.Fetch(context.Background()); err == nil {
+		t.Errorf("fetch without the fallback must fail")
+	}
+}
+
+func TestNewHTTPClientCAFile(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testJWKS)) // nolint:errcheck
+	}))
+	defer srv.Close()
+
+	config := testRemoteConfig()
+
+	// the test server certificate is not trusted by the system pool
+	client, err := NewHTTPClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewRemote(srv.URL, config, client).Fetch(context.Background()); err == nil {
+		t.Fatal("fetch from an untrusted server must fail")
+	}
+
+	config.CAFile = filepath.Join(t.TempDir(), "ca.pem")
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(config.CAFile, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err = NewHTTPClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewRemote(srv.URL, config, client).Fetch(context.Background()); err != nil {
+		t.Fatal("fetch with the CA file:", err)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	tests := []struct {
+		cacheControl string
+		age          string
+		want         time.Duration
+		wantOk       bool
+	}{
+		{"", "", 0, false},
+		{"public", "", 0, false},
+		{"public, max-age=300", "", 300 * time.Second, true},
+		{"max-age=300", "100", 200 * time.Second, true},
+		{"max-age=300", "400", 0, true},
+		{"no-cache", "", 0, true},
+		{"max-age=300, no-store", "", 0, true},
+		{"max-age=invalid", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cacheControl, func(t *testing.T) {
+			header := http.Header{}
+			header.Set("Cache-Control", tt.cacheControl)
+			if tt.age != "" {
+				header.Set("Age", tt.age)
+			}
+
+			got, ok := maxAge(header)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("maxAge() = %s, %v, want %s, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
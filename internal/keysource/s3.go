@@ -0,0 +1,350 @@
+package keysource
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3Config configures an S3 compatible object storage source
+type S3Config struct {
+	// the url of the service, empty for AWS S3 in Region, set it for MinIO and the other compatible services
+	Endpoint string
+
+	Region string
+	Bucket string
+
+	// only the objects under the prefix are loaded, the key id is derived from the object key relative to it
+	Prefix string
+
+	// address the bucket in the path instead of the host name, usually required by MinIO
+	PathStyle bool
+
+	// the credentials, the AWS environment variables are used if empty, the requests are not signed if
+	// no credentials are found
+	Credentials AWSCredentials
+
+	// joins the path elements of an object key relative to the prefix to form the key id
+	KidPathSeparator string
+
+	// the larger objects are skipped, 0 for unlimited
+	MaxObjectSize int64
+
+	// the interval to list the bucket for changes, 0 disables watching
+	PollInterval time.Duration
+}
+
+// Enabled returns true if a bucket is configured
+func (c *S3Config) Enabled() bool {
+	return c.Bucket != ""
+}
+
+// Validate checks the config
+func (c *S3Config) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	if c.Region == "" {
+		return errors.New("s3-region is required")
+	}
+
+	if c.Endpoint != "" {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("s3-endpoint %s must be an absolute http or https url", c.Endpoint)
+		}
+	}
+
+	if c.PollInterval < 0 {
+		return errors.New("s3-poll-interval must not be negative")
+	}
+
+	return nil
+}
+
+// S3 loads the keys from the objects of a bucket, one key in an object
+// the objects are downloaded again only when their ETag changes
+type S3 struct {
+	config S3Config
+	client *http.Client
+
+	// the objects downloaded by the last fetch, and the signature of the listing, protected by m
+	m        sync.Mutex
+	objects  map[string]s3CachedObject
+	listSign string
+}
+
+type s3CachedObject struct {
+	etag string
+	data []byte
+}
+
+// s3Object is an entry of the ListObjectsV2 response
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+}
+
+// NewS3 creates an object storage source, the client is usually created with NewHTTPClient
+func NewS3(config S3Config, client *http.Client) *S3 {
+	config.Credentials = config.Credentials.orEnv()
+
+	return &S3{
+		config:  config,
+		client:  client,
+		objects: map[string]s3CachedObject{},
+	}
+}
+
+func (s *S3) Name() string {
+	return "s3:" + s.config.Bucket + "/" + s.config.Prefix
+}
+
+// Fetch lists the objects under the prefix and downloads the new and the changed ones
+func (s *S3) Fetch(ctx context.Context) (*Snapshot, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	objects, err := s.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{
+		Skipped: map[string]string{},
+	}
+
+	cache := make(map[string]s3CachedObject, len(objects))
+
+	for _, o := range objects {
+		name := strings.TrimPrefix(strings.TrimPrefix(o.Key, s.config.Prefix), "/")
+
+		if skip, reason := s.skipObject(name, o); skip {
+			if reason != "" {
+				snapshot.Skipped[name] = reason
+			}
+			continue
+		}
+
+		cached, ok := s.objects[o.Key]
+		if !ok || cached.etag != o.ETag {
+			data, err := s.get(ctx, o.Key)
+			if err != nil {
+				return nil, fmt.Errorf("downloading object %s: %w", o.Key, err)
+			}
+
+			cached = s3CachedObject{etag: o.ETag, data: data}
+		}
+
+		cache[o.Key] = cached
+
+		snapshot.Keys = append(snapshot.Keys, KeyData{
+			Name:    name,
+			Kid:     KidFromPath(name, s.config.KidPathSeparator),
+			Data:    cached.data,
+			ModTime: o.LastModified,
+		})
+	}
+
+	s.objects = cache
+	s.listSign = listSignature(objects)
+
+	return snapshot, nil
+}
+
+// skipObject returns true if the object is not a key, the reason is empty for the folder placeholders
+func (s *S3) skipObject(name string, o s3Object) (bool, string) {
+	switch {
+	case name == "" || strings.HasSuffix(name, "/"):
+		return true, ""
+
+	case strings.HasPrefix(path.Base(name), "."):
+		return true, "hidden file"
+
+	case strings.HasSuffix(name, ".ignore"):
+		return true, "ignored file"
+
+	case s.config.MaxObjectSize > 0 && o.Size > s.config.MaxObjectSize:
+		return true, fmt.Sprintf("object too large: %d bytes, max %d", o.Size, s.config.MaxObjectSize)
+	}
+
+	return false, ""
+}
+
+// Watch lists the objects every PollInterval and calls changed if the listing differs from the last fetch
+func (s *S3) Watch(ctx context.Context, changed func()) error {
+	if s.config.PollInterval <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	ticker := time.NewTicker(s.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+			objects, err := s.list(ctx)
+			if err != nil {
+				log.Error().Err(err).Str("bucket", s.config.Bucket).Msg("listing bucket failed")
+				continue
+			}
+
+			s.m.Lock()
+			same := listSignature(objects) == s.listSign
+			s.m.Unlock()
+
+			if !same {
+				log.Debug().Str("bucket", s.config.Bucket).Msg("bucket changed")
+				changed()
+			}
+		}
+	}
+}
+
+// list returns all the objects under the prefix, following the continuation tokens
+func (s *S3) list(ctx context.Context) ([]s3Object, error) {
+	var objects []s3Object
+	var token string
+
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		if s.config.Prefix != "" {
+			query.Set("prefix", s.config.Prefix)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		body, err := s.do(ctx, "", query)
+		if err != nil {
+			return nil, fmt.Errorf("listing objects: %w", err)
+		}
+
+		var result struct {
+			Contents              []s3Object `xml:"Contents"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+		}
+
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("decoding object list: %w", err)
+		}
+
+		objects = append(objects, result.Contents...)
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+
+		token = result.NextContinuationToken
+	}
+}
+
+// get downloads an object
+func (s *S3) get(ctx context.Context, key string) ([]byte, error) {
+	return s.do(ctx, key, nil)
+}
+
+// do makes a signed GET request for the object key, or for the bucket if the key is empty
+func (s *S3) do(ctx context.Context, key string, query url.Values) ([]byte, error) {
+	u, err := s.url(key)
+	if err != nil {
+		return nil, err
+	}
+
+	u.RawQuery = awsQueryEncode(query)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	if s.config.Credentials.AccessKeyID != "" {
+		signV4(req, nil, s.config.Credentials, s.config.Region, "s3", time.Now())
+	}
+
+	req.Header.Set("User-Agent", "go-jwks-server")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("reading response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var s3Err struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+
+		if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+			return nil, fmt.Errorf("status %s: %s: %s", resp.Status, s3Err.Code, s3Err.Message)
+		}
+
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+
+	if len(body) > maxRemoteBodySize {
+		return nil, fmt.Errorf("response larger than %d bytes", maxRemoteBodySize)
+	}
+
+	return body, nil
+}
+
+// url returns the url of the object key, or of the bucket if the key is empty
+func (s *S3) url(key string) (*url.URL, error) {
+	endpoint := s.config.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + s.config.Region + ".amazonaws.com"
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing endpoint: %w", err)
+	}
+
+	if s.config.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.config.Bucket + "/" + key
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + key
+	}
+
+	// the path is sent exactly as it is signed
+	u.RawPath = awsURIEncode(u.Path, false)
+
+	return u, nil
+}
+
+// listSignature identifies the listing, it changes if an object is added, removed or modified
+func listSignature(objects []s3Object) string {
+	lines := make([]string, 0, len(objects))
+	for _, o := range objects {
+		lines = append(lines, fmt.Sprintf("%s %s %d", o.Key, o.ETag, o.Size))
+	}
+	sort.Strings(lines)
+
+	return sha256Hex([]byte(strings.Join(lines, "\n")))
+}
@@ -0,0 +1,286 @@
+package keysource
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 serves the objects of one bucket with the path style ListObjectsV2 and GetObject APIs
+type fakeS3 struct {
+	bucket string
+
+	m       sync.Mutex
+	objects map[string]string
+	gets    []string
+	authErr bool
+}
+
+func (f *fakeS3) put(key, data string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.objects[key] = data
+}
+
+func (f *fakeS3) takeGets() []string {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	gets := f.gets
+	f.gets = nil
+	sort.Strings(gets)
+
+	return gets
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+		f.authErr = true
+		http.Error(w, "<Error><Code>AccessDenied</Code><Message>no signature</Message></Error>", http.StatusForbidden)
+		return
+	}
+
+	// S3 signs the query as it was received
+	if r.URL.RawQuery != canonicalQuery(r) {
+		f.authErr = true
+		http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/"+f.bucket+"/")
+
+	if key != "" {
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+
+		f.gets = append(f.gets, key)
+		w.Write([]byte(data)) // nolint:errcheck
+		return
+	}
+
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	// two objects per page, the continuation token is the index of the next object
+	start := 0
+	if token := r.URL.Query().Get("continuation-token"); token != "" {
+		start = int(token[0] - '0')
+	}
+
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+
+	for i := start; i < len(keys) && i < start+2; i++ {
+		sum := md5.Sum([]byte(f.objects[keys[i]]))
+
+		result.Contents = append(result.Contents, content{
+			Key:          keys[i],
+			LastModified: "2024-06-05T16:49:05.000Z",
+			ETag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+			Size:         len(f.objects[keys[i]]),
+		})
+	}
+
+	if start+2 < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = string(rune('0' + start + 2))
+	}
+
+	xml.NewEncoder(w).Encode(result) // nolint:errcheck
+}
+
+func TestS3Fetch(t *testing.T) {
+	fake := &fakeS3{
+		bucket: "keys-bucket",
+		objects: map[string]string{
+			"jwks/key1.pub":        "key1",
+			"jwks/team-a/key2":     "key2",
+			"jwks/key3.ignore":     "key3",
+			"jwks/.hidden":         "hidden",
+			"jwks/large":           strings.Repeat("x", 100),
+			"jwks/folder/":         "",
+			"other/not-under-jwks": "other",
+		},
+	}
+
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s := NewS3(S3Config{
+		Endpoint:         srv.URL,
+		Region:           "us-east-1",
+		Bucket:           fake.bucket,
+		Prefix:           "jwks/",
+		PathStyle:        true,
+		Credentials:      AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"},
+		KidPathSeparator: ":",
+		MaxObjectSize:    50,
+		PollInterval:     10 * time.Millisecond,
+	}, srv.Client())
+
+	snapshot, err := s.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	if fake.authErr {
+		t.Fatal("a request was not signed")
+	}
+
+	kids := map[string]string{}
+	for _, kd := range snapshot.Keys {
+		kids[kd.Kid] = string(kd.Data)
+	}
+
+	wantKids := map[string]string{"key1": "key1", "team-a:key2": "key2"}
+	if !reflect.DeepEqual(kids, wantKids) {
+		t.Errorf("keys = %v, want %v", kids, wantKids)
+	}
+
+	wantSkipped := map[string]string{
+		"key3.ignore": "ignored file",
+		".hidden":     "hidden file",
+		"large":       "object too large: 100 bytes, max 50",
+	}
+	if !reflect.DeepEqual(snapshot.Skipped, wantSkipped) {
+		t.Errorf("skipped = %v, want %v", snapshot.Skipped, wantSkipped)
+	}
+
+	if gets := fake.takeGets(); !reflect.DeepEqual(gets, []string{"jwks/key1.pub", "jwks/team-a/key2"}) {
+		t.Errorf("downloaded objects = %v", gets)
+	}
+
+	// nothing changed, nothing is downloaded
+	if _, err := s.Fetch(context.Background()); err != nil {
+		t.Fatal("second fetch:", err)
+	}
+
+	if gets := fake.takeGets(); len(gets) != 0 {
+		t.Errorf("unchanged objects downloaded again: %v", gets)
+	}
+
+	// a changed object is noticed by the watch and downloaded again
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	go s.Watch(ctx, func() { // nolint:errcheck
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	})
+
+	fake.put("jwks/key1.pub", "key1-rotated")
+
+	select {
+	case <-changed:
+	case <-ctx.Done():
+		t.Fatal("the change was not noticed")
+	}
+
+	snapshot, err = s.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch after the change:", err)
+	}
+
+	if gets := fake.takeGets(); !reflect.DeepEqual(gets, []string{"jwks/key1.pub"}) {
+		t.Errorf("downloaded objects after the change = %v", gets)
+	}
+
+	for _, kd := range snapshot.Keys {
+		if kd.Kid == "key1" && string(kd.Data) != "key1-rotated" {
+			t.Errorf("key1 was not updated: %s", kd.Data)
+		}
+	}
+}
+
+func TestS3URL(t *testing.T) {
+	tests := []struct {
+		config S3Config
+		key    string
+		want   string
+	}{
+		{S3Config{Region: "eu-west-1", Bucket: "b"}, "keys/key 1", "https://b.s3.eu-west-1.amazonaws.com/keys/key%201"},
+		{S3Config{Endpoint: "http://minio:9000", Bucket: "b", PathStyle: true}, "key1", "http://minio:9000/b/key1"},
+		{S3Config{Endpoint: "http://minio:9000/", Bucket: "b", PathStyle: true}, "", "http://minio:9000/b/"},
+	}
+
+	for _, tt := range tests {
+		u, err := (&S3{config: tt.config}).url(tt.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if u.String() != tt.want {
+			t.Errorf("url(%q) = %s, want %s", tt.key, u, tt.want)
+		}
+	}
+}
+
+func TestS3PrefixWithSpace(t *testing.T) {
+	fake := &fakeS3{
+		bucket: "keys-bucket",
+		objects: map[string]string{
+			"team keys/key1.pub": "key1",
+			"team+keys/key2.pub": "key2",
+		},
+	}
+
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s := NewS3(S3Config{
+		Endpoint:    srv.URL,
+		Region:      "us-east-1",
+		Bucket:      fake.bucket,
+		Prefix:      "team keys/",
+		PathStyle:   true,
+		Credentials: AWSCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"},
+	}, srv.Client())
+
+	snapshot, err := s.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	if fake.authErr {
+		t.Fatal("the query sent is not the one signed")
+	}
+
+	if len(snapshot.Keys) != 1 || snapshot.Keys[0].Kid != "key1" {
+		t.Errorf("keys = %+v, want key1 only", snapshot.Keys)
+	}
+}
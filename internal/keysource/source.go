@@ -0,0 +1,124 @@
+package keysource
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+)
+
+/*
+	this package provides the sources of the key material published by the keyloader
+
+	a source lists and fetches the raw key material (PEM or JWK/JWKS JSON), the keyloader
+	parses it, runs the hooks and merges the keys of all the sources into the published set
+*/
+
+// KeySource is a place the keys are loaded from
+type KeySource interface {
+	// Name identifies the source in the logs and in the load reports
+	Name() string
+
+	// Fetch lists and fetches the key material currently available in the source
+	Fetch(ctx context.Context) (*Snapshot, error)
+
+	// Watch blocks until the context is done, calling changed every time the key material may have changed,
+	// spurious calls are allowed, a source that can not detect changes just waits for the context
+	Watch(ctx context.Context, changed func()) error
+}
+
+// Snapshot is the key material of a source at a point in time
+type Snapshot struct {
+	Keys []KeyData
+
+	// the entries of the source that were not considered and the reason, by name
+	Skipped map[string]string
+
+	// optional source specific version of the snapshot
+	Version string
+}
+
+// KeyData is the raw material of one or more keys
+type KeyData struct {
+	// identifies the material within the source (file name, object key, ...)
+	Name string
+
+	// the key id of the keys that do not have one in their material,
+	// if the material has several keys without a key id, -<n> is appended to it for the n-th key
+	Kid string
+
+	// Kid is the key id of all the keys, a different key id in the material is an error instead of taking precedence
+	KidStrict bool
+
+	// optional prefix of the key ids of all the keys, to avoid the conflicts with the keys of other sources
+	KidPrefix string
+
+	// PEM encoded public keys or JWK/JWKS JSON
+	Data []byte
+
+	// the modification time of the material, zero if unknown
+	ModTime time.Time
+
+	// optional algorithm and use of the keys, they replace the ones in the material
+	Alg string
+	Use string
+
+	// optional validity window of the keys, the keys are published only inside it
+	NotBefore time.Time
+	Expires   time.Time
+
+	// optional labels of the keys, reported with the published keys, see keyloader.KeyInfo
+	Labels map[string]string
+
+	// optional other key ids the key is published under, only for the key material with a single key
+	Aliases []Alias
+}
+
+// Alias is another key id of a key, a copy of the key is published under it until it expires,
+// KeyData.KidPrefix applies to it
+type Alias struct {
+	Kid string
+
+	// zero if the alias does not expire before the key
+	Expires time.Time
+}
+
+// ValidateAlgUse checks the alg and use given as metadata of the keys, empty values are valid
+func ValidateAlgUse(alg, use string) error {
+	switch use {
+	case "", "sig", "enc":
+	default:
+		return fmt.Errorf("use %s must be sig or enc", use)
+	}
+
+	if alg != "" {
+		var sig jwa.SignatureAlgorithm
+		var enc jwa.KeyEncryptionAlgorithm
+
+		if sig.Accept(alg) != nil && enc.Accept(alg) != nil {
+			return fmt.Errorf("unknown alg %s", alg)
+		}
+	}
+
+	return nil
+}
+
+// ParseTimestamp parses an RFC 3339 timestamp or unix seconds, empty is zero
+func ParseTimestamp(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("timestamp %s must be RFC 3339 or unix seconds", value)
+	}
+
+	return parsed, nil
+}
@@ -0,0 +1,380 @@
+package keysource
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SQLConfig configures a database source
+type SQLConfig struct {
+	// the name of a registered database/sql driver (postgres, sqlite) and its data source name
+	Driver string
+	DSN    string `json:"-"`
+
+	// returns one row per key, the columns are matched by name: kid and key are required,
+	// alg, use, nbf and exp are optional
+	Query string
+
+	// optional query returning a watermark, like max(updated_at) or a version, the keys are loaded
+	// again when it changes, the whole Query is compared if empty
+	WatermarkQuery string
+
+	// the interval to check for changes, 0 disables watching
+	PollInterval time.Duration
+
+	// the timeout of a query
+	Timeout time.Duration
+}
+
+// NewSQLConfig creates the config with the default values
+func NewSQLConfig() SQLConfig {
+	return SQLConfig{
+		Driver:       "postgres",
+		Query:        "SELECT kid, key, alg, use, nbf, exp FROM jwks_keys",
+		PollInterval: 30 * time.Second,
+		Timeout:      10 * time.Second,
+	}
+}
+
+// Enabled returns true if a data source name is configured
+func (c *SQLConfig) Enabled() bool {
+	return c.DSN != ""
+}
+
+// Validate checks the config
+func (c *SQLConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	if c.Driver == "" {
+		return errors.New("sql-driver is required")
+	}
+
+	if strings.TrimSpace(c.Query) == "" {
+		return errors.New("sql-query is required")
+	}
+
+	if c.PollInterval < 0 {
+		return errors.New("sql-poll-interval must not be negative")
+	}
+
+	if c.Timeout <= 0 {
+		return errors.New("sql-timeout must be positive")
+	}
+
+	return nil
+}
+
+// SQL loads the keys from the rows returned by a query, one key in a row
+type SQL struct {
+	config SQLConfig
+	db     *sql.DB
+
+	// the watermark of the last fetch, protected by m
+	m         sync.Mutex
+	watermark string
+}
+
+// NewSQL opens the database, the driver must be registered
+// the connection is made by the first fetch, so a database that is down at startup is handled like any failing source
+func NewSQL(config SQLConfig) (*SQL, error) {
+	db, err := sql.Open(config.Driver, config.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+
+	return newSQL(config, db), nil
+}
+
+func newSQL(config SQLConfig, db *sql.DB) *SQL {
+	return &SQL{
+		config: config,
+		db:     db,
+	}
+}
+
+func (s *SQL) Name() string {
+	return "sql:" + s.config.Driver
+}
+
+// Fetch reads the watermark, then the keys, so a change made between the two queries is loaded again
+func (s *SQL) Fetch(ctx context.Context) (*Snapshot, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+
+	watermark, err := s.readWatermark(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, skipped, err := s.readKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.config.WatermarkQuery == "" {
+		watermark = keysSignature(keys)
+	}
+
+	s.m.Lock()
+	s.watermark = watermark
+	s.m.Unlock()
+
+	return &Snapshot{Keys: keys, Skipped: skipped, Version: watermark}, nil
+}
+
+// readKeys runs the query and converts the rows to key data, the rows with an invalid alg or use are skipped,
+// the reasons are returned by kid
+func (s *SQL) readKeys(ctx context.Context) ([]KeyData, map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, s.config.Query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("querying keys: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading the columns: %w", err)
+	}
+
+	index := map[string]int{}
+	for i, c := range columns {
+		index[strings.ToLower(c)] = i
+	}
+
+	for _, required := range []string{"kid", "key"} {
+		if _, ok := index[required]; !ok {
+			return nil, nil, fmt.Errorf("the query does not return the %s column", required)
+		}
+	}
+
+	var keys []KeyData
+	skipped := map[string]string{}
+
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, nil, fmt.Errorf("reading a row: %w", err)
+		}
+
+		column := func(name string) interface{} {
+			if i, ok := index[name]; ok {
+				return values[i]
+			}
+			return nil
+		}
+
+		kid := sqlString(column("kid"))
+		if kid == "" {
+			return nil, nil, errors.New("a row has an empty kid")
+		}
+
+		kd := KeyData{
+			Name: kid,
+			Kid:  kid,
+			Data: []byte(sqlString(column("key"))),
+			Alg:  sqlString(column("alg")),
+			Use:  sqlString(column("use")),
+		}
+
+		if err := ValidateAlgUse(kd.Alg, kd.Use); err != nil {
+			skipped[kid] = err.Error()
+			continue
+		}
+
+		if kd.NotBefore, err = sqlTime(column("nbf")); err != nil {
+			return nil, nil, fmt.Errorf("key %s: nbf: %w", kid, err)
+		}
+
+		if kd.Expires, err = sqlTime(column("exp")); err != nil {
+			return nil, nil, fmt.Errorf("key %s: exp: %w", kid, err)
+		}
+
+		keys = append(keys, kd)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("reading the rows: %w", err)
+	}
+
+	return keys, skipped, nil
+}
+
+// readWatermark runs the watermark query, all the columns of the first row make the watermark
+func (s *SQL) readWatermark(ctx context.Context) (string, error) {
+	if s.config.WatermarkQuery == "" {
+		return "", nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.config.WatermarkQuery)
+	if err != nil {
+		return "", fmt.Errorf("querying watermark: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", fmt.Errorf("reading the watermark columns: %w", err)
+	}
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return "", fmt.Errorf("reading the watermark: %w", err)
+		}
+
+		return "", nil
+	}
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	if err := rows.Scan(pointers...); err != nil {
+		return "", fmt.Errorf("reading the watermark: %w", err)
+	}
+
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = sqlString(v)
+	}
+
+	return strings.Join(parts, "/"), nil
+}
+
+// Watch checks the watermark every PollInterval and calls changed if it differs from the one of the last fetch,
+// the database is closed when it returns
+func (s *SQL) Watch(ctx context.Context, changed func()) error {
+	defer s.db.Close()
+
+	if s.config.PollInterval <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	ticker := time.NewTicker(s.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+			watermark, err := s.poll(ctx)
+			if err != nil {
+				log.Error().Err(err).Msg("polling the database failed")
+				continue
+			}
+
+			s.m.Lock()
+			same := watermark == s.watermark
+			s.m.Unlock()
+
+			if !same {
+				log.Debug().Str("watermark", watermark).Msg("database keys changed")
+				changed()
+			}
+		}
+	}
+}
+
+// poll returns the current watermark, or the signature of the keys without a watermark query
+func (s *SQL) poll(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.Timeout)
+	defer cancel()
+
+	if s.config.WatermarkQuery != "" {
+		return s.readWatermark(ctx)
+	}
+
+	keys, _, err := s.readKeys(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return keysSignature(keys), nil
+}
+
+// keysSignature identifies the key data, it changes if a key is added, removed or modified
+func keysSignature(keys []KeyData) string {
+	lines := make([]string, 0, len(keys))
+	for _, kd := range keys {
+		lines = append(lines, strings.Join([]string{kd.Kid, sha256Hex(kd.Data), kd.Alg, kd.Use,
+			kd.NotBefore.String(), kd.Expires.String()}, " "))
+	}
+
+	return sha256Hex([]byte(strings.Join(lines, "\n")))[:16]
+}
+
+// sqlString converts a column value to a string, NULL is empty
+func sqlString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// the layouts accepted for the timestamps stored as text
+var sqlTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+}
+
+// sqlTime converts a column value to a time, NULL is zero, the numbers are unix seconds
+// and the text must be in one of sqlTimeLayouts, without a zone it is UTC
+func sqlTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case nil:
+		return time.Time{}, nil
+	case time.Time:
+		return v, nil
+	case int64:
+		return time.Unix(v, 0), nil
+	case float64:
+		return time.Unix(int64(v), 0), nil
+	case []byte:
+		return sqlTime(string(v))
+	case string:
+		if v == "" {
+			return time.Time{}, nil
+		}
+
+		if seconds, err := strconv.ParseInt(v, 10, 64); err == nil {
+			return time.Unix(seconds, 0), nil
+		}
+
+		for _, layout := range sqlTimeLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, nil
+			}
+		}
+
+		return time.Time{}, fmt.Errorf("invalid time %q", v)
+	default:
+		return time.Time{}, fmt.Errorf("unsupported type %T", v)
+	}
+}
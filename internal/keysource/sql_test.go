@@ -0,0 +1,152 @@
+package keysource
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestSQLFetch(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "keys.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	exec := func(query string, args ...interface{}) {
+		t.Helper()
+
+		if _, err := db.Exec(query, args...); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+
+	exec(`CREATE TABLE jwks_keys (kid TEXT, key TEXT, alg TEXT, use TEXT, nbf TEXT, exp INTEGER, updated_at INTEGER)`)
+	exec(`INSERT INTO jwks_keys VALUES ('key1', 'material1', 'RS256', 'sig', '2024-06-05 16:49:05', NULL, 1)`)
+	exec(`INSERT INTO jwks_keys VALUES ('key2', 'material2', NULL, NULL, NULL, 1717606145, 2)`)
+	exec(`INSERT INTO jwks_keys VALUES ('bad', 'material', 'RS256', 'sign', NULL, NULL, 1)`)
+
+	config := NewSQLConfig()
+	config.Driver = "sqlite"
+	config.WatermarkQuery = "SELECT max(updated_at), count(*) FROM jwks_keys"
+	config.PollInterval = 10 * time.Millisecond
+
+	s := newSQL(config, db)
+
+	snapshot, err := s.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	if len(snapshot.Keys) != 2 {
+		t.Fatalf("keys = %+v", snapshot.Keys)
+	}
+
+	// the invalid row is skipped, the others are loaded
+	if want := map[string]string{"bad": "use sign must be sig or enc"}; !reflect.DeepEqual(snapshot.Skipped, want) {
+		t.Errorf("skipped = %v, want %v", snapshot.Skipped, want)
+	}
+
+	key1, key2 := snapshot.Keys[0], snapshot.Keys[1]
+
+	if key1.Kid != "key1" || string(key1.Data) != "material1" || key1.Alg != "RS256" || key1.Use != "sig" {
+		t.Errorf("unexpected key1 %+v", key1)
+	}
+
+	if !key1.NotBefore.Equal(time.Date(2024, 6, 5, 16, 49, 5, 0, time.UTC)) || !key1.Expires.IsZero() {
+		t.Errorf("unexpected key1 window %s - %s", key1.NotBefore, key1.Expires)
+	}
+
+	if key2.Alg != "" || !key2.NotBefore.IsZero() || !key2.Expires.Equal(time.Unix(1717606145, 0)) {
+		t.Errorf("unexpected key2 %+v", key2)
+	}
+
+	if snapshot.Version != "2/3" {
+		t.Errorf("version = %s, want the watermark 2/3", snapshot.Version)
+	}
+
+	// a new row moves the watermark
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	watchDone := make(chan struct{})
+	go func() {
+		s.Watch(ctx, func() { // nolint:errcheck
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+		close(watchDone)
+	}()
+
+	exec(`INSERT INTO jwks_keys VALUES ('key3', 'material3', NULL, NULL, NULL, NULL, 3)`)
+
+	select {
+	case <-changed:
+	case <-ctx.Done():
+		t.Fatal("the new row was not noticed")
+	}
+
+	// the query must return the kid and the key
+	s = newSQL(SQLConfig{Driver: "sqlite", Query: "SELECT kid FROM jwks_keys", Timeout: time.Second}, db)
+
+	if _, err := s.Fetch(context.Background()); err == nil {
+		t.Errorf("fetch without the key column must fail")
+	}
+
+	// the database is closed when the watch returns
+	cancel()
+	<-watchDone
+
+	if err := db.Ping(); err == nil {
+		t.Errorf("the database must be closed after the watch")
+	}
+
+	// a database that can not be reached fails the fetch, not the creation of the source
+	config.DSN = filepath.Join(t.TempDir(), "missing", "keys.db")
+
+	unreachable, err := NewSQL(config)
+	if err != nil {
+		t.Fatal("NewSQL() with an unreachable database:", err)
+	}
+	defer unreachable.db.Close()
+
+	if _, err := unreachable.Fetch(context.Background()); err == nil {
+		t.Errorf("Fetch() with an unreachable database must fail")
+	}
+}
+
+func TestSQLTime(t *testing.T) {
+	tests := []struct {
+		v       interface{}
+		want    time.Time
+		wantErr bool
+	}{
+		{nil, time.Time{}, false},
+		{int64(1717606145), time.Unix(1717606145, 0), false},
+		{"1717606145", time.Unix(1717606145, 0), false},
+		{[]byte("2024-06-05T16:49:05Z"), time.Date(2024, 6, 5, 16, 49, 5, 0, time.UTC), false},
+		{"2024-06-05 16:49:05+02:00", time.Date(2024, 6, 5, 14, 49, 5, 0, time.UTC), false},
+		{"yesterday", time.Time{}, true},
+		{true, time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := sqlTime(tt.v)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("sqlTime(%v) error = %v, wantErr %v", tt.v, err, tt.wantErr)
+			continue
+		}
+
+		if !got.Equal(tt.want) {
+			t.Errorf("sqlTime(%v) = %s, want %s", tt.v, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package keysource
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultConfig configures a Vault transit source
+type VaultConfig struct {
+	// the url of Vault, VAULT_ADDR if empty
+	Address string
+
+	// the token, VAULT_TOKEN if empty, not printed with the config
+	Token string `json:"-"`
+
+	// the file with the token, read on every request (Vault agent sink), it takes precedence over Token
+	TokenFile string
+
+	// the optional Vault Enterprise namespace
+	Namespace string
+
+	// the mount path of the transit engine
+	Mount string
+
+	// the names of the transit keys to publish
+	Keys []string
+
+	// the interval to read the keys for new versions, 0 disables watching
+	PollInterval time.Duration
+
+	// renew the token before its TTL expires, if it is renewable, ignored with TokenFile as the writer of the file
+	// (a Vault agent) owns the token
+	RenewToken bool
+
+	// the timeout of a request and the optional CA bundle of Vault
+	Timeout time.Duration
+	CAFile  string
+}
+
+// NewVaultConfig creates the config with the default values
+func NewVaultConfig() VaultConfig {
+	return VaultConfig{
+		Mount:        "transit",
+		PollInterval: 1 * time.Minute,
+		RenewToken:   true,
+		Timeout:      10 * time.Second,
+	}
+}
+
+// Enabled returns true if a transit key is configured
+func (c *VaultConfig) Enabled() bool {
+	return len(c.Keys) > 0
+}
+
+// Validate checks the config
+func (c *VaultConfig) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	for _, k := range c.Keys {
+		if k == "" || strings.Contains(k, "/") {
+			return fmt.Errorf("vault-transit-key %q must be a key name", k)
+		}
+	}
+
+	if strings.Trim(c.Mount, "/") == "" {
+		return errors.New("vault-transit-mount must not be empty")
+	}
+
+	if c.PollInterval < 0 {
+		return errors.New("vault-poll-interval must not be negative")
+	}
+
+	if c.Timeout <= 0 {
+		return errors.New("vault-timeout must be positive")
+	}
+
+	return nil
+}
+
+// Vault publishes the public keys of transit keys, every available version of a key
+// is published with the key id <name>-v<version>
+type Vault struct {
+	config VaultConfig
+	client *http.Client
+
+	// the signature of the keys read by the last fetch, protected by m
+	m    sync.Mutex
+	sign string
+}
+
+// vaultTransitKey is the data of the read key response of the transit engine
+type vaultTransitKey struct {
+	Type string `json:"type"`
+
+	// by version, the symmetric keys have the creation time instead of an object
+	Keys map[string]json.RawMessage `json:"keys"`
+}
+
+type vaultKeyVersion struct {
+	PublicKey    string    `json:"public_key"`
+	CreationTime time.Time `json:"creation_time"`
+}
+
+// NewVault creates a Vault transit source
+func NewVault(config VaultConfig) (*Vault, error) {
+	if config.Address == "" {
+		config.Address = os.Getenv("VAULT_ADDR")
+	}
+
+	if config.Address == "" {
+		return nil, errors.New("no Vault address, provide the vault-addr or VAULT_ADDR")
+	}
+
+	if config.Token == "" && config.TokenFile == "" {
+		config.Token = os.Getenv("VAULT_TOKEN")
+	}
+
+	client, err := NewHTTPClient(RemoteConfig{Timeout: config.Timeout, CAFile: config.CAFile})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Vault{
+		config: config,
+		client: client,
+	}, nil
+}
+
+func (v *Vault) Name() string {
+	return "vault:" + strings.Trim(v.config.Mount, "/") + "/" + strings.Join(v.config.Keys, ",")
+}
+
+// Fetch reads every transit key and returns the public key of every version
+func (v *Vault) Fetch(ctx context.Context) (*Snapshot, error) {
+	keys, err := v.readKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{}
+
+	for _, name := range v.config.Keys {
+		versions, err := transitVersions(name, keys[name])
+		if err != nil {
+			return nil, err
+		}
+
+		snapshot.Keys = append(snapshot.Keys, versions...)
+	}
+
+	v.m.Lock()
+	v.sign = transitSignature(keys)
+	v.m.Unlock()
+
+	return snapshot, nil
+}
+
+// transitVersions converts the versions of the key to key data, in the order of the versions
+func transitVersions(name string, key vaultTransitKey) ([]KeyData, error) {
+	numbers := make([]int, 0, len(key.Keys))
+	for version := range key.Keys {
+		n, err := strconv.Atoi(version)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: invalid version %q", name, version)
+		}
+
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	var keys []KeyData
+
+	for _, n := range numbers {
+		var version vaultKeyVersion
+		if err := json.Unmarshal(key.Keys[strconv.Itoa(n)], &version); err != nil || version.PublicKey == "" {
+			return nil, fmt.Errorf("key %s of type %s has no public key", name, key.Type)
+		}
+
+		data := []byte(version.PublicKey)
+
+		// the ed25519 public keys are returned base64 encoded, the others PEM encoded
+		if key.Type == "ed25519" {
+			raw, err := base64.StdEncoding.DecodeString(version.PublicKey)
+			if err != nil || len(raw) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("key %s version %d: invalid ed25519 public key", name, n)
+			}
+
+			der, err := x509.MarshalPKIXPublicKey(ed25519.PublicKey(raw))
+			if err != nil {
+				return nil, fmt.Errorf("key %s version %d: %w", name, n, err)
+			}
+
+			data = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+		}
+
+		keys = append(keys, KeyData{
+			Name:    fmt.Sprintf("%s/%d", name, n),
+			Kid:     fmt.Sprintf("%s-v%d", name, n),
+			Data:    data,
+			ModTime: version.CreationTime,
+		})
+	}
+
+	return keys, nil
+}
+
+// readKeys reads the configured transit keys, by name
+func (v *Vault) readKeys(ctx context.Context) (map[string]vaultTransitKey, error) {
+	keys := make(map[string]vaultTransitKey, len(v.config.Keys))
+
+	for _, name := range v.config.Keys {
+		var resp struct {
+			Data vaultTransitKey `json:"data"`
+		}
+
+		path := strings.Trim(v.config.Mount, "/") + "/keys/" + url.PathEscape(name)
+
+		if err := v.do(ctx, http.MethodGet, path, &resp); err != nil {
+			return nil, fmt.Errorf("reading transit key %s: %w", name, err)
+		}
+
+		keys[name] = resp.Data
+	}
+
+	return keys, nil
+}
+
+// Watch reads the keys every PollInterval and calls changed if a version was added or removed,
+// the token is renewed in the background, unless it is read from TokenFile
+func (v *Vault) Watch(ctx context.Context, changed func()) error {
+	if v.config.RenewToken && v.config.TokenFile == "" {
+		go v.renewToken(ctx)
+	}
+
+	if v.config.PollInterval <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+
+	ticker := time.NewTicker(v.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case <-ticker.C:
+			keys, err := v.readKeys(ctx)
+			if err != nil {
+				log.Error().Err(err).Msg("reading the transit keys failed")
+				continue
+			}
+
+			v.m.Lock()
+			same := transitSignature(keys) == v.sign
+			v.m.Unlock()
+
+			if !same {
+				log.Debug().Msg("transit keys changed")
+				changed()
+			}
+		}
+	}
+}
+
+// renewToken renews the token when half of its TTL is left, until the context is done
+// or the token turns out not to be renewable
+func (v *Vault) renewToken(ctx context.Context) {
+	var lookup struct {
+		Data struct {
+			TTL       int  `json:"ttl"`
+			Renewable bool `json:"renewable"`
+		} `json:"data"`
+	}
+
+	if err := v.do(ctx, http.MethodGet, "auth/token/lookup-self", &lookup); err != nil {
+		log.Error().Err(err).Msg("looking up the Vault token failed, the token is not renewed")
+		return
+	}
+
+	if !lookup.Data.Renewable || lookup.Data.TTL <= 0 {
+		log.Debug().Msg("the Vault token is not renewable")
+		return
+	}
+
+	ttl := time.Duration(lookup.Data.TTL) * time.Second
+
+	for {
+		sleepCtx(ctx, ttl/2)
+		if ctx.Err() != nil {
+			return
+		}
+
+		var renew struct {
+			Auth struct {
+				LeaseDuration int  `json:"lease_duration"`
+				Renewable     bool `json:"renewable"`
+			} `json:"auth"`
+		}
+
+		if err := v.do(ctx, http.MethodPost, "auth/token/renew-self", &renew); err != nil {
+			// try again before the token expires
+			log.Error().Err(err).Msg("renewing the Vault token failed")
+			ttl /= 2
+			if ttl < 2*time.Second {
+				return
+			}
+			continue
+		}
+
+		ttl = time.Duration(renew.Auth.LeaseDuration) * time.Second
+		log.Debug().Dur("ttl", ttl).Msg("renewed the Vault token")
+
+		if !renew.Auth.Renewable || ttl <= 0 {
+			return
+		}
+	}
+}
+
+// do makes a request to the Vault API and decodes the response into out
+func (v *Vault) do(ctx context.Context, method, path string, out interface{}) error {
+	token := v.config.Token
+
+	if v.config.TokenFile != "" {
+		data, err := os.ReadFile(v.config.TokenFile)
+		if err != nil {
+			return fmt.Errorf("reading the token file: %w", err)
+		}
+
+		token = strings.TrimSpace(string(data))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(v.config.Address, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return fmt.Errorf("creating request: %w", err)
+	}
+
+	req.Header.Set("X-Vault-Token", token)
+	req.Header.Set("User-Agent", "go-jwks-server")
+
+	if v.config.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.config.Namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRemoteBodySize))
+	if err != nil {
+		return fmt.Errorf("reading response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+
+		if json.Unmarshal(body, &vaultErr) == nil && len(vaultErr.Errors) > 0 {
+			return fmt.Errorf("status %s: %s", resp.Status, strings.Join(vaultErr.Errors, ", "))
+		}
+
+		return fmt.Errorf("status %s", resp.Status)
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+
+	return nil
+}
+
+// transitSignature identifies the versions of the keys, it changes if a version is added or removed
+func transitSignature(keys map[string]vaultTransitKey) string {
+	var lines []string
+	for name, key := range keys {
+		for version, data := range key.Keys {
+			lines = append(lines, name+"/"+version+"/"+string(bytes.TrimSpace(data)))
+		}
+	}
+	sort.Strings(lines)
+
+	return sha256Hex([]byte(strings.Join(lines, "\n")))
+}
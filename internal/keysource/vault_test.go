@@ -0,0 +1,186 @@
+package keysource
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVaultFetch(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lookups, renewals int32
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/transit/keys/signer", func(w http.ResponseWriter, r *http.Request) {
+		// version 1 was trimmed with min_available_version
+		json.NewEncoder(w).Encode(map[string]interface{}{ // nolint:errcheck
+			"data": map[string]interface{}{
+				"type": "ecdsa-p256",
+				"keys": map[string]interface{}{
+					"2": map[string]string{"public_key": ecPEM, "creation_time": "2024-06-05T16:49:05Z"},
+					"3": map[string]string{"public_key": ecPEM, "creation_time": "2024-07-05T16:49:05Z"},
+				},
+			},
+		})
+	})
+	mux.HandleFunc("/v1/transit/keys/edkey", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{ // nolint:errcheck
+			"data": map[string]interface{}{
+				"type": "ed25519",
+				"keys": map[string]interface{}{
+					"1": map[string]string{"public_key": base64.StdEncoding.EncodeToString(edPub)},
+				},
+			},
+		})
+	})
+	mux.HandleFunc("/v1/transit/keys/aes", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{ // nolint:errcheck
+			"data": map[string]interface{}{
+				"type": "aes256-gcm96",
+				"keys": map[string]interface{}{"1": 1717606145},
+			},
+		})
+	})
+	mux.HandleFunc("/v1/auth/token/lookup-self", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lookups, 1)
+		w.Write([]byte(`{"data":{"ttl":1,"renewable":true}}`)) // nolint:errcheck
+	})
+	mux.HandleFunc("/v1/auth/token/renew-self", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&renewals, 1)
+		w.Write([]byte(`{"auth":{"lease_duration":1,"renewable":false}}`)) // nolint:errcheck
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`)) // nolint:errcheck
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	config := NewVaultConfig()
+	config.Address = srv.URL
+	config.Token = "test-token"
+	config.Keys = []string{"signer", "edkey"}
+	config.PollInterval = 0
+
+	v, err := NewVault(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := v.Fetch(context.Background())
+	if err != nil {
+		t.Fatal("fetch:", err)
+	}
+
+	var kids []string
+	for _, kd := range snapshot.Keys {
+		kids = append(kids, kd.Kid)
+
+		if block, _ := pem.Decode(kd.Data); block == nil || block.Type != "PUBLIC KEY" {
+			t.Errorf("key %s is not a PEM public key", kd.Kid)
+		}
+	}
+
+	if !reflect.DeepEqual(kids, []string{"signer-v2", "signer-v3", "edkey-v1"}) {
+		t.Errorf("kids = %v", kids)
+	}
+
+	// the symmetric keys have no public key
+	config.Keys = []string{"aes"}
+
+	v, err = NewVault(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := v.Fetch(context.Background()); err == nil {
+		t.Errorf("fetch of a symmetric key must fail")
+	}
+
+	// the token is renewed in the background of the watch
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	go v.Watch(ctx, func() {}) // nolint:errcheck
+
+	for atomic.LoadInt32(&renewals) == 0 && ctx.Err() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if atomic.LoadInt32(&renewals) != 1 {
+		t.Errorf("the token was not renewed")
+	}
+
+	cancel()
+
+	// the token of a token file belongs to the agent writing it, it is not renewed
+	config.TokenFile = filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(config.TokenFile, []byte("test-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err = NewVault(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := atomic.LoadInt32(&lookups)
+
+	fileCtx, fileCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer fileCancel()
+
+	v.Watch(fileCtx, func() {}) // nolint:errcheck
+
+	if atomic.LoadInt32(&lookups) != before {
+		t.Errorf("the token of the token file must not be renewed")
+	}
+
+	config.TokenFile = ""
+
+	// a wrong token
+	config.Token = "wrong"
+
+	v, err = NewVault(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := v.Fetch(context.Background()); err == nil {
+		t.Errorf("fetch with a wrong token must fail")
+	}
+}
@@ -0,0 +1,76 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+type Config struct {
+	// the URLs to post the key set changes to, no webhooks are sent if empty
+	URLs []string
+
+	// the secret used to sign the payload with HMAC-SHA256, not printed with the config
+	Secret string `json:"-"`
+
+	// timeout of a single delivery attempt
+	Timeout time.Duration
+
+	// the number of retries after a failed delivery attempt
+	MaxRetries int
+
+	// the delay before the first retry, it doubles on every retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// NewConfig creates a new config with default values
+func NewConfig() Config {
+	return Config{
+		Timeout:    5 * time.Second,
+		MaxRetries: 5,
+		Backoff:    time.Second,
+		MaxBackoff: time.Minute,
+	}
+}
+
+func (c *Config) Validate() error {
+	if len(c.URLs) == 0 {
+		return nil
+	}
+
+	for _, u := range c.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return fmt.Errorf("invalid webhook url %s: %w", u, err)
+		}
+
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return fmt.Errorf("invalid webhook url %s: scheme must be http or https", u)
+		}
+	}
+
+	if c.Secret == "" {
+		return errors.New("webhook-secret is required when webhooks are enabled")
+	}
+
+	if c.Timeout <= 0 {
+		return errors.New("webhook-timeout must be positive")
+	}
+
+	if c.MaxRetries < 0 {
+		return errors.New("webhook-max-retries must not be negative")
+	}
+
+	if c.Backoff <= 0 || c.MaxBackoff < c.Backoff {
+		return errors.New("webhook-backoff must be positive and not greater than webhook-max-backoff")
+	}
+
+	return nil
+}
+
+// Enabled returns true if at least one webhook url is configured
+func (c *Config) Enabled() bool {
+	return len(c.URLs) > 0
+}
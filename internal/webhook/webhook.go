@@ -0,0 +1,183 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go-jwks-server/internal/keyloader"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+	this package notifies webhook targets when the published keys change
+
+	the payload is a JSON object with the new key set version and the key id diff,
+	it is signed with HMAC-SHA256 using the configured secret, the hex encoded signature
+	is sent in the X-Jwks-Signature header as "sha256=<signature>"
+*/
+
+// SignatureHeader is the header carrying the HMAC signature of the payload
+const SignatureHeader = "X-Jwks-Signature"
+
+// Payload is the body of the webhook requests
+type Payload struct {
+	Version string             `json:"version"`
+	Diff    keyloader.KeysDiff `json:"diff"`
+	SentAt  time.Time          `json:"sentAt"`
+}
+
+type Notifier struct {
+	config Config
+	client *http.Client
+}
+
+func New(config Config) (*Notifier, error) {
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("config validation: %w", err)
+	}
+
+	n := &Notifier{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+
+	return n, nil
+}
+
+// Run delivers every diff received from the channel to all the targets until the context is done
+// the deliveries to a target are sequential, so a target receives the diffs in order
+func (n *Notifier) Run(ctx context.Context, diffs <-chan keyloader.KeysDiff) error {
+	queues := make([]chan keyloader.KeysDiff, len(n.config.URLs))
+
+	wg := sync.WaitGroup{}
+
+	for i, u := range n.config.URLs {
+		queues[i] = make(chan keyloader.KeysDiff, 16)
+
+		wg.Add(1)
+		go func(url string, queue <-chan keyloader.KeysDiff) {
+			defer wg.Done()
+
+			for diff := range queue {
+				n.deliver(ctx, url, diff)
+			}
+		}(u, queues[i])
+	}
+
+	log.Info().Strs("urls", n.config.URLs).Msg("webhooks started")
+	defer log.Info().Msg("webhooks stopped")
+
+	defer wg.Wait()
+
+	defer func() {
+		for _, q := range queues {
+			close(q)
+		}
+	}()
+
+	for {
+		select {
+		case diff, ok := <-diffs:
+			if !ok {
+				return nil
+			}
+
+			for i, q := range queues {
+				select {
+				case q <- diff:
+				default:
+					log.Error().Str("url", n.config.URLs[i]).Str("version", diff.Version).
+						Msg("webhook queue is full, delivery dropped")
+				}
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// deliver posts the diff to the url, retrying with exponential backoff
+func (n *Notifier) deliver(ctx context.Context, url string, diff keyloader.KeysDiff) {
+	logger := log.With().Str("url", url).Str("version", diff.Version).Logger()
+
+	body, err := json.Marshal(Payload{
+		Version: diff.Version,
+		Diff:    diff,
+		SentAt:  time.Now().UTC(),
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("failed to marshal webhook payload")
+		return
+	}
+
+	backoff := n.config.Backoff
+
+	for attempt := 1; ; attempt++ {
+		err := n.post(ctx, url, body)
+		if err == nil {
+			logger.Info().Int("attempt", attempt).Msg("webhook delivered")
+			return
+		}
+
+		if attempt > n.config.MaxRetries {
+			logger.Error().Err(err).Int("attempt", attempt).Msg("webhook delivery failed, giving up")
+			return
+		}
+
+		logger.Warn().Err(err).Int("attempt", attempt).Dur("retryIn", backoff).Msg("webhook delivery failed, will retry")
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			logger.Error().Int("attempt", attempt).Msg("webhook delivery aborted, shutting down")
+			return
+		}
+
+		backoff *= 2
+		if backoff > n.config.MaxBackoff {
+			backoff = n.config.MaxBackoff
+		}
+	}
+}
+
+func (n *Notifier) post(ctx context.Context, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-jwks-server")
+	req.Header.Set(SignatureHeader, "sha256="+Sign(n.config.Secret, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// drain the body to allow connection reuse
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the body, receivers can use it to verify the payload
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,89 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"go-jwks-server/internal/keyloader"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotifierRun(t *testing.T) {
+	const secret = "test-secret"
+
+	var m sync.Mutex
+	attempts := 0
+	received := make(chan Payload, 1)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		attempts++
+		attempt := attempts
+		m.Unlock()
+
+		// fail the first attempt to exercise the retries
+		if attempt == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error("failed to read body:", err)
+			return
+		}
+
+		if got, want := r.Header.Get(SignatureHeader), "sha256="+Sign(secret, body); got != want {
+			t.Errorf("signature = %s, want %s", got, want)
+		}
+
+		var p Payload
+		if err := json.Unmarshal(body, &p); err != nil {
+			t.Error("failed to unmarshal payload:", err)
+		}
+
+		received <- p
+	}))
+	defer srv.Close()
+
+	config := NewConfig()
+	config.URLs = []string{srv.URL}
+	config.Secret = secret
+	config.Backoff = 10 * time.Millisecond
+
+	n, err := New(config)
+	if err != nil {
+		t.Fatal("New() error:", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	diffs := make(chan keyloader.KeysDiff, 1)
+	diffs <- keyloader.KeysDiff{Added: []string{"key1"}, Version: "v1"}
+
+	done := make(chan error)
+	go func() {
+		done <- n.Run(ctx, diffs)
+	}()
+
+	select {
+	case p := <-received:
+		if p.Version != "v1" || !reflect.DeepEqual(p.Diff.Added, []string{"key1"}) {
+			t.Errorf("received payload = %#v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+
+	cancel()
+
+	if err := <-done; err != nil {
+		t.Error("Run() error:", err)
+	}
+}